@@ -4,62 +4,1158 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"math"
 	"net/http"
+	"net/http/httptrace"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 )
 
 // ElasticsearchNodesPlugin mackerel plugin for Elasticsearch
 type ElasticsearchNodesPlugin struct {
-	URI   string
-	Stats map[string](map[string]float64)
+	URI            string
+	Stats          map[string](map[string]float64)
+	ClusterStats   map[string]float64
+	StateFile      string
+	DeltaNodes     bool
+	DeltaThreshold float64
+	Unchanged      map[string]bool
+	StatePruneRuns uint64
+	GroupByTier    bool
+	MaxMetrics     int
+	NodeAttr       string
+	ExpectCluster  string
+	PrefixByRole   bool
+	RolePriority   []string
+	RoleGroups     map[string]string
+	DataPaths      bool
+	HTTPClients    bool
+	SegmentsMemory bool
+
+	// StateReadOnly leaves the state file as it was, for runs that are not
+	// the agent's.
+	StateReadOnly bool
+	// Labels holds per node what the "*" of a metric key stands for where
+	// the key had to be sanitized, such as a version.
+	Labels map[string]map[string]string
+
+	AdaptiveSelection       bool
+	AdaptiveSelectionMatrix bool
+
+	ThreadPoolQueueSizes map[string]float64
+	// ThreadPools lists the thread pools to emit, or is nil for all of them.
+	ThreadPools map[string]bool
+	// ScriptContexts lists the script contexts to emit.
+	ScriptContexts map[string]bool
+	// IngestPipelines matches the ingest pipelines to emit, if any.
+	IngestPipelines *regexp.Regexp
 }
 
 type ElasticsearchCluster struct {
-	ClusterName string `json:"cluster_name"`
+	NodesHeader *ElasticsearchNodesHeader `json:"_nodes"`
+	ClusterName string                    `json:"cluster_name"`
 	Nodes       map[string]ElasticsearchNode
 }
 
+// ElasticsearchNodesHeader tells how many nodes answered the request.
+type ElasticsearchNodesHeader struct {
+	Total      float64 `json:"total"`
+	Successful float64 `json:"successful"`
+	Failed     float64 `json:"failed"`
+}
+
 type ElasticsearchNode struct {
-	Name    string `json:"name"`
-	Os      ElasticsearchNodeOs
-	Process ElasticsearchNodeProcess
-	Jvm     ElasticsearchNodeJvm
-	Fs      ElasticsearchNodeFs
+	Name       string            `json:"name"`
+	Timestamp  float64           `json:"timestamp"`
+	Roles      []string          `json:"roles"`
+	Attributes map[string]string `json:"attributes"`
+	Os         ElasticsearchNodeOs
+	Process    ElasticsearchNodeProcess
+	Jvm        ElasticsearchNodeJvm
+	Fs         *ElasticsearchNodeFs
+	Indices    ElasticsearchNodeIndices
+	ThreadPool map[string]ElasticsearchNodeThreadPool `json:"thread_pool"`
+	Breakers   map[string]ElasticsearchNodeBreaker
+	Transport  *ElasticsearchNodeTransport
+	Http       *ElasticsearchNodeHttp
+	Script     *ElasticsearchNodeScript
+	// ScriptCache is only reported by Elasticsearch 7.9 and later.
+	ScriptCache *ElasticsearchNodeScriptCache `json:"script_cache"`
+	Ingest      *ElasticsearchNodeIngest
+	Discovery   *ElasticsearchNodeDiscovery
+	// AdaptiveSelection holds the node's view of each node it searches, by
+	// node ID.
+	AdaptiveSelection map[string]ElasticsearchNodeAdaptiveSelection `json:"adaptive_selection"`
+
+	IndexingPressure *ElasticsearchNodeIndexingPressure `json:"indexing_pressure"`
+}
+
+// ElasticsearchNodesInfo is the subset of the /_nodes (node info) response
+// the plugin uses.
+type ElasticsearchNodesInfo struct {
+	Nodes map[string]ElasticsearchNodeInfo
+}
+
+type ElasticsearchNodeInfo struct {
+	Name       string                                     `json:"name"`
+	Version    string                                     `json:"version"`
+	ThreadPool map[string]ElasticsearchNodeInfoThreadPool `json:"thread_pool"`
+	Os         ElasticsearchNodeInfoOs                    `json:"os"`
+
+	TotalIndexingBuffer float64 `json:"total_indexing_buffer"`
+}
+
+type ElasticsearchNodeInfoOs struct {
+	AllocatedProcessors float64 `json:"allocated_processors"`
+}
+
+type ElasticsearchNodeInfoThreadPool struct {
+	// QueueSize is a number, -1 for unbounded queues, on current versions
+	// and a string such as "1k" on Elasticsearch 1.x.
+	QueueSize interface{} `json:"queue_size"`
 }
 
 type ElasticsearchNodeOs struct {
-	LoadAverage float64 `json:"load_average"`
+	// LoadAverage is where Elasticsearch 2.x and earlier report load.
+	LoadAverage ElasticsearchNodeOsLoadAverage `json:"load_average"`
+	Cpu         ElasticsearchNodeOsCpu
+	Mem         ElasticsearchNodeOsMem
+	Swap        ElasticsearchNodeOsSwap
+	// Cgroup is only reported when Elasticsearch runs in a cgroup.
+	Cgroup *ElasticsearchNodeOsCgroup
+
+	// CpuPercent is where Elasticsearch 2.x reports CPU usage.
+	CpuPercent *float64 `json:"cpu_percent"`
+}
+
+type ElasticsearchNodeOsCpu struct {
+	Percent     *float64                          `json:"percent"`
+	LoadAverage ElasticsearchNodeOsCpuLoadAverage `json:"load_average"`
+
+	// Usage is where Elasticsearch 1.x reports CPU usage.
+	Usage *float64 `json:"usage"`
+}
+
+// ElasticsearchNodeOsCpuLoadAverage is the load average object of
+// Elasticsearch 5 and later. Windows the OS does not provide are left out.
+type ElasticsearchNodeOsCpuLoadAverage struct {
+	OneMinute      *float64 `json:"1m"`
+	FiveMinutes    *float64 `json:"5m"`
+	FifteenMinutes *float64 `json:"15m"`
+}
+
+// ElasticsearchNodeOsLoadAverage is the 1 minute load average reported by
+// Elasticsearch 2.x or the 1, 5 and 15 minute ones reported by 1.x.
+type ElasticsearchNodeOsLoadAverage []float64
+
+func (l *ElasticsearchNodeOsLoadAverage) UnmarshalJSON(b []byte) error {
+	var one float64
+	if err := json.Unmarshal(b, &one); err == nil {
+		*l = ElasticsearchNodeOsLoadAverage{one}
+		return nil
+	}
+
+	return json.Unmarshal(b, (*[]float64)(l))
+}
+
+type ElasticsearchNodeOsMem struct {
+	TotalInBytes float64 `json:"total_in_bytes"`
+	// AdjustedTotalInBytes reflects the memory limit of the container
+	// Elasticsearch runs in, where it knows it.
+	AdjustedTotalInBytes *float64 `json:"adjusted_total_in_bytes"`
+	FreeInBytes          float64  `json:"free_in_bytes"`
+	UsedInBytes          float64  `json:"used_in_bytes"`
+	UsedPercent          *float64 `json:"used_percent"`
+}
+
+type ElasticsearchNodeOsSwap struct {
+	TotalInBytes float64 `json:"total_in_bytes"`
+	FreeInBytes  float64 `json:"free_in_bytes"`
+	UsedInBytes  float64 `json:"used_in_bytes"`
+}
+
+type ElasticsearchNodeOsCgroup struct {
+	Cpuacct *ElasticsearchNodeOsCgroupCpuacct
+	Cpu     *ElasticsearchNodeOsCgroupCpu
+	Memory  *ElasticsearchNodeOsCgroupMemory
+}
+
+type ElasticsearchNodeOsCgroupCpuacct struct {
+	UsageNanos float64 `json:"usage_nanos"`
+}
+
+type ElasticsearchNodeOsCgroupCpu struct {
+	Stat ElasticsearchNodeOsCgroupCpuStat
+}
+
+type ElasticsearchNodeOsCgroupCpuStat struct {
+	NumberOfTimesThrottled float64 `json:"number_of_times_throttled"`
+	TimeThrottledNanos     float64 `json:"time_throttled_nanos"`
+}
+
+// ElasticsearchNodeOsCgroupMemory holds values that Elasticsearch reports as
+// strings, as they may be "max" when there is no limit.
+type ElasticsearchNodeOsCgroupMemory struct {
+	LimitInBytes interface{} `json:"limit_in_bytes"`
+	UsageInBytes interface{} `json:"usage_in_bytes"`
+}
+
+// numberValue returns the number v holds, if any, whether it was decoded
+// from a JSON number or a string.
+func numberValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+func (nodeOs ElasticsearchNodeOs) addStats(nodeStats map[string]float64) {
+	loadAverage := nodeOs.Cpu.LoadAverage
+	legacyKeys := []string{"os_load_average_1m", "os_load_average_5m", "os_load_average_15m"}
+	for i, value := range nodeOs.LoadAverage {
+		if i < len(legacyKeys) {
+			nodeStats[legacyKeys[i]] = value
+		}
+	}
+	if loadAverage.OneMinute != nil {
+		nodeStats["os_load_average_1m"] = *loadAverage.OneMinute
+	}
+	if loadAverage.FiveMinutes != nil {
+		nodeStats["os_load_average_5m"] = *loadAverage.FiveMinutes
+	}
+	if loadAverage.FifteenMinutes != nil {
+		nodeStats["os_load_average_15m"] = *loadAverage.FifteenMinutes
+	}
+	switch {
+	case nodeOs.Cpu.Percent != nil:
+		nodeStats["os_cpu_percent"] = *nodeOs.Cpu.Percent
+	case nodeOs.CpuPercent != nil:
+		nodeStats["os_cpu_percent"] = *nodeOs.CpuPercent
+	case nodeOs.Cpu.Usage != nil:
+		nodeStats["os_cpu_percent"] = *nodeOs.Cpu.Usage
+	}
+	// Used and free are reported against the host's memory. With an
+	// adjusted total, such as a container's limit, used is taken from the
+	// cgroup where reported and otherwise derived from free, so that all
+	// three are on the same basis.
+	memTotal, memFree, memUsed := nodeOs.Mem.TotalInBytes, nodeOs.Mem.FreeInBytes, nodeOs.Mem.UsedInBytes
+	if adjusted := nodeOs.Mem.AdjustedTotalInBytes; adjusted != nil && *adjusted > 0 {
+		memTotal = *adjusted
+		memUsed = math.Max(memTotal-memFree, 0)
+		if nodeOs.Cgroup != nil && nodeOs.Cgroup.Memory != nil {
+			if usage, ok := numberValue(nodeOs.Cgroup.Memory.UsageInBytes); ok {
+				memUsed = usage
+			}
+		}
+		memUsed = math.Min(memUsed, memTotal)
+		memFree = memTotal - memUsed
+	}
+	if memTotal > 0 {
+		nodeStats["os_mem_total_in_bytes"] = memTotal
+		nodeStats["os_mem_free_in_bytes"] = memFree
+		nodeStats["os_mem_used_in_bytes"] = memUsed
+		nodeStats["os_mem_used_percent"] = memUsed / memTotal * 100
+	} else if nodeOs.Mem.UsedPercent != nil {
+		nodeStats["os_mem_used_percent"] = *nodeOs.Mem.UsedPercent
+	}
+	// Swap used is emitted even when swap is disabled, so that the graph
+	// stays at zero instead of disappearing.
+	nodeStats["os_swap_used_in_bytes"] = nodeOs.Swap.UsedInBytes
+	if nodeOs.Swap.TotalInBytes > 0 {
+		nodeStats["os_swap_total_in_bytes"] = nodeOs.Swap.TotalInBytes
+		nodeStats["os_swap_free_in_bytes"] = nodeOs.Swap.FreeInBytes
+	}
+	if nodeOs.Cgroup != nil && nodeOs.Cgroup.Cpu != nil {
+		nodeStats["os_cgroup_cpu_stat_number_of_times_throttled"] = nodeOs.Cgroup.Cpu.Stat.NumberOfTimesThrottled
+		nodeStats["os_cgroup_cpu_stat_time_throttled_nanos"] = nodeOs.Cgroup.Cpu.Stat.TimeThrottledNanos
+	}
+	if nodeOs.Cgroup != nil && nodeOs.Cgroup.Memory != nil {
+		if usage, ok := numberValue(nodeOs.Cgroup.Memory.UsageInBytes); ok {
+			nodeStats["os_cgroup_memory_usage_in_bytes"] = usage
+			if limit, ok := numberValue(nodeOs.Cgroup.Memory.LimitInBytes); ok && limit > 0 {
+				nodeStats["os_cgroup_memory_limit_in_bytes"] = limit
+				nodeStats["os_cgroup_memory_usage_percent"] = usage / limit * 100
+			}
+		}
+	}
 }
 
 type ElasticsearchNodeProcess struct {
-	Cpu ElasticsearchNodeProcessCpu
+	Cpu                 ElasticsearchNodeProcessCpu
+	Mem                 *ElasticsearchNodeProcessMem
+	OpenFileDescriptors *float64 `json:"open_file_descriptors"`
+	// MaxFileDescriptors is -1 where Elasticsearch cannot tell.
+	MaxFileDescriptors *float64 `json:"max_file_descriptors"`
 }
 
 type ElasticsearchNodeProcessCpu struct {
-	Percent float64
+	Percent       float64
+	TotalInMillis *float64 `json:"total_in_millis"`
+}
+
+type ElasticsearchNodeProcessMem struct {
+	TotalVirtualInBytes float64 `json:"total_virtual_in_bytes"`
+}
+
+func (process ElasticsearchNodeProcess) addStats(nodeStats map[string]float64) {
+	nodeStats["process_cpu_percent"] = process.Cpu.Percent
+	if process.Cpu.TotalInMillis != nil {
+		nodeStats["process_cpu_total_in_millis"] = *process.Cpu.TotalInMillis
+	}
+	if process.Mem != nil {
+		nodeStats["process_mem_total_virtual_in_bytes"] = process.Mem.TotalVirtualInBytes
+	}
+	if process.OpenFileDescriptors != nil {
+		nodeStats["process_open_file_descriptors"] = *process.OpenFileDescriptors
+		if maxFds := process.MaxFileDescriptors; maxFds != nil && *maxFds > 0 {
+			nodeStats["process_max_file_descriptors"] = *maxFds
+			nodeStats["process_file_descriptors_used_percent"] = *process.OpenFileDescriptors / *maxFds * 100
+		}
+	}
 }
 
 type ElasticsearchNodeJvm struct {
-	Mem ElasticsearchNodeJvmMem
+	UptimeInMillis float64 `json:"uptime_in_millis"`
+	Mem            ElasticsearchNodeJvmMem
+	Threads        ElasticsearchNodeJvmThreads
+	Gc             ElasticsearchNodeJvmGc
+	BufferPools    map[string]ElasticsearchNodeJvmBufferPool `json:"buffer_pools"`
+	Classes        *ElasticsearchNodeJvmClasses
 }
 
 type ElasticsearchNodeJvmMem struct {
-	HeapUsedInBytes float64 `json:"heap_used_in_bytes"`
+	HeapUsedInBytes         float64 `json:"heap_used_in_bytes"`
+	HeapUsedPercent         float64 `json:"heap_used_percent"`
+	HeapMaxInBytes          float64 `json:"heap_max_in_bytes"`
+	HeapCommittedInBytes    float64 `json:"heap_committed_in_bytes"`
+	NonHeapUsedInBytes      float64 `json:"non_heap_used_in_bytes"`
+	NonHeapCommittedInBytes float64 `json:"non_heap_committed_in_bytes"`
+	Pools                   map[string]ElasticsearchNodeJvmMemPool
+}
+
+// ElasticsearchNodeJvmMemPool is a memory pool, keyed by the names
+// Elasticsearch normalizes them to: young, survivor and old.
+type ElasticsearchNodeJvmMemPool struct {
+	UsedInBytes     float64 `json:"used_in_bytes"`
+	MaxInBytes      float64 `json:"max_in_bytes"`
+	PeakUsedInBytes float64 `json:"peak_used_in_bytes"`
+}
+
+type ElasticsearchNodeJvmThreads struct {
+	Count     float64 `json:"count"`
+	PeakCount float64 `json:"peak_count"`
+}
+
+// ElasticsearchNodeJvmGc holds collectors by the names Elasticsearch
+// normalizes them to, young and old, whichever collector the JVM runs
+// (ParNew, ConcurrentMarkSweep, G1 Old Generation, ...).
+type ElasticsearchNodeJvmGc struct {
+	Collectors map[string]ElasticsearchNodeJvmGcCollector
+}
+
+type ElasticsearchNodeJvmGcCollector struct {
+	CollectionCount        float64 `json:"collection_count"`
+	CollectionTimeInMillis float64 `json:"collection_time_in_millis"`
+}
+
+type ElasticsearchNodeJvmBufferPool struct {
+	Count                float64 `json:"count"`
+	UsedInBytes          float64 `json:"used_in_bytes"`
+	TotalCapacityInBytes float64 `json:"total_capacity_in_bytes"`
+}
+
+type ElasticsearchNodeJvmClasses struct {
+	CurrentLoadedCount float64 `json:"current_loaded_count"`
+	TotalLoadedCount   float64 `json:"total_loaded_count"`
+	TotalUnloadedCount float64 `json:"total_unloaded_count"`
+}
+
+func (jvm ElasticsearchNodeJvm) addStats(nodeStats map[string]float64) {
+	nodeStats["jvm_uptime_in_seconds"] = jvm.UptimeInMillis / 1000
+	nodeStats["jvm_mem_heap_used_in_bytes"] = jvm.Mem.HeapUsedInBytes
+	nodeStats["jvm_mem_heap_used_percent"] = jvm.Mem.HeapUsedPercent
+	nodeStats["jvm_mem_heap_max_in_bytes"] = jvm.Mem.HeapMaxInBytes
+	nodeStats["jvm_mem_heap_committed_in_bytes"] = jvm.Mem.HeapCommittedInBytes
+	nodeStats["jvm_mem_non_heap_used_in_bytes"] = jvm.Mem.NonHeapUsedInBytes
+	nodeStats["jvm_mem_non_heap_committed_in_bytes"] = jvm.Mem.NonHeapCommittedInBytes
+	for _, name := range []string{"young", "survivor", "old"} {
+		if pool, ok := jvm.Mem.Pools[name]; ok {
+			nodeStats["jvm_mem_pools_"+name+"_used_in_bytes"] = pool.UsedInBytes
+			nodeStats["jvm_mem_pools_"+name+"_max_in_bytes"] = pool.MaxInBytes
+			nodeStats["jvm_mem_pools_"+name+"_peak_used_in_bytes"] = pool.PeakUsedInBytes
+		}
+	}
+	nodeStats["jvm_threads_count"] = jvm.Threads.Count
+	nodeStats["jvm_threads_peak_count"] = jvm.Threads.PeakCount
+	for _, name := range []string{"young", "old"} {
+		if collector, ok := jvm.Gc.Collectors[name]; ok {
+			nodeStats["jvm_gc_collectors_"+name+"_collection_count"] = collector.CollectionCount
+			nodeStats["jvm_gc_collectors_"+name+"_collection_time_in_millis"] = collector.CollectionTimeInMillis
+		}
+	}
+	for _, name := range []string{"direct", "mapped"} {
+		if pool, ok := jvm.BufferPools[name]; ok {
+			nodeStats["jvm_buffer_pools_"+name+"_count"] = pool.Count
+			nodeStats["jvm_buffer_pools_"+name+"_used_in_bytes"] = pool.UsedInBytes
+			nodeStats["jvm_buffer_pools_"+name+"_total_capacity_in_bytes"] = pool.TotalCapacityInBytes
+		}
+	}
+	if classes := jvm.Classes; classes != nil {
+		nodeStats["jvm_classes_current_loaded_count"] = classes.CurrentLoadedCount
+		nodeStats["jvm_classes_total_loaded_count"] = classes.TotalLoadedCount
+		nodeStats["jvm_classes_total_unloaded_count"] = classes.TotalUnloadedCount
+	}
 }
 
 type ElasticsearchNodeFs struct {
 	Total ElasticsearchNodeFsTotal
+	Data  []ElasticsearchNodeFsData
+	// IoStats is only reported on Linux.
+	IoStats *ElasticsearchNodeFsIoStats `json:"io_stats"`
 }
 
 type ElasticsearchNodeFsTotal struct {
 	TotalInBytes float64 `json:"total_in_bytes"`
 	FreeInBytes  float64 `json:"free_in_bytes"`
+	// AvailableInBytes excludes blocks reserved for root, and is what the
+	// disk watermarks are checked against.
+	AvailableInBytes *float64 `json:"available_in_bytes"`
 }
 
-func (p *ElasticsearchNodesPlugin) loadStats() error {
-	resp, err := http.Get(p.URI + "/_nodes/stats")
+type ElasticsearchNodeFsData struct {
+	Path             string   `json:"path"`
+	Mount            string   `json:"mount"`
+	TotalInBytes     float64  `json:"total_in_bytes"`
+	FreeInBytes      float64  `json:"free_in_bytes"`
+	AvailableInBytes *float64 `json:"available_in_bytes"`
+}
+
+func (data ElasticsearchNodeFsData) addStats(nodeStats map[string]float64) {
+	name := data.Path
+	if name == "" {
+		name = data.Mount
+	}
+	key := "fs_data_" + sanitizeMetricName(name)
+	nodeStats[key+"_total_in_bytes"] = data.TotalInBytes
+	nodeStats[key+"_free_in_bytes"] = data.FreeInBytes
+	nodeStats[key+"_disk_used_in_bytes"] = data.TotalInBytes - data.FreeInBytes
+	if available := data.AvailableInBytes; available != nil {
+		nodeStats[key+"_available_in_bytes"] = *available
+		if data.TotalInBytes > 0 {
+			nodeStats[key+"_disk_used_percent"] = (data.TotalInBytes - *available) / data.TotalInBytes * 100
+		}
+	}
+}
+
+type ElasticsearchNodeFsIoStats struct {
+	Total ElasticsearchNodeFsIoStatsTotal
+}
+
+type ElasticsearchNodeFsIoStatsTotal struct {
+	Operations      float64 `json:"operations"`
+	ReadOperations  float64 `json:"read_operations"`
+	WriteOperations float64 `json:"write_operations"`
+	ReadKilobytes   float64 `json:"read_kilobytes"`
+	WriteKilobytes  float64 `json:"write_kilobytes"`
+}
+
+func (fs ElasticsearchNodeFs) addStats(nodeStats map[string]float64) {
+	nodeStats["disk_used_in_bytes"] = fs.Total.TotalInBytes - fs.Total.FreeInBytes
+	nodeStats["disk_free_in_bytes"] = fs.Total.FreeInBytes
+	if available := fs.Total.AvailableInBytes; available != nil {
+		nodeStats["disk_available_in_bytes"] = *available
+		if fs.Total.TotalInBytes > 0 {
+			nodeStats["disk_used_percent"] = (fs.Total.TotalInBytes - *available) / fs.Total.TotalInBytes * 100
+		}
+	}
+	if fs.IoStats != nil {
+		total := fs.IoStats.Total
+		nodeStats["fs_io_stats_total_operations"] = total.Operations
+		nodeStats["fs_io_stats_total_read_operations"] = total.ReadOperations
+		nodeStats["fs_io_stats_total_write_operations"] = total.WriteOperations
+		nodeStats["fs_io_stats_total_read_kilobytes"] = total.ReadKilobytes
+		nodeStats["fs_io_stats_total_write_kilobytes"] = total.WriteKilobytes
+	}
+}
+
+type ElasticsearchNodeIndices struct {
+	Docs     ElasticsearchNodeIndicesDocs
+	Store    ElasticsearchNodeIndicesStore
+	Indexing ElasticsearchNodeIndicesIndexing
+	Search   ElasticsearchNodeIndicesSearch
+	Get      ElasticsearchNodeIndicesGet
+	Merges   ElasticsearchNodeIndicesMerges
+	Refresh  ElasticsearchNodeIndicesRefresh
+	Warmer   ElasticsearchNodeIndicesWarmer
+	// QueryCache was the filter cache before Elasticsearch 2.0.
+	QueryCache *ElasticsearchNodeIndicesQueryCache `json:"query_cache"`
+	Fielddata  ElasticsearchNodeIndicesFielddata
+	// RequestCache is only reported by Elasticsearch 2.0 and later.
+	RequestCache *ElasticsearchNodeIndicesRequestCache `json:"request_cache"`
+	Completion   ElasticsearchNodeIndicesCompletion
+	Translog     ElasticsearchNodeIndicesTranslog
+	Recovery     *ElasticsearchNodeIndicesRecovery
+	// ShardStats is only reported by Elasticsearch 7.15 and later.
+	ShardStats *ElasticsearchNodeIndicesShardStats `json:"shard_stats"`
+	// Mappings is only reported by Elasticsearch 8.4 and later, and its
+	// fields vary between versions.
+	Mappings *ElasticsearchNodeIndicesMappings
+	// Bulk is only reported by Elasticsearch 8.0 and later.
+	Bulk *ElasticsearchNodeIndicesBulk
+	// DenseVector is only reported by Elasticsearch 8.x.
+	DenseVector *ElasticsearchNodeIndicesDenseVector `json:"dense_vector"`
+	Flush       ElasticsearchNodeIndicesFlush
+	Segments    ElasticsearchNodeIndicesSegments
+}
+
+type ElasticsearchNodeIndicesDocs struct {
+	Count   float64 `json:"count"`
+	Deleted float64 `json:"deleted"`
+}
+
+type ElasticsearchNodeIndicesStore struct {
+	SizeInBytes float64 `json:"size_in_bytes"`
+	// ReservedInBytes is only reported by Elasticsearch 7.9 and later.
+	ReservedInBytes *float64 `json:"reserved_in_bytes"`
+}
+
+type ElasticsearchNodeIndicesIndexing struct {
+	IndexTotal        float64 `json:"index_total"`
+	IndexTimeInMillis float64 `json:"index_time_in_millis"`
+	IndexCurrent      float64 `json:"index_current"`
+	IndexFailed       float64 `json:"index_failed"`
+
+	DeleteTotal        float64  `json:"delete_total"`
+	DeleteTimeInMillis float64  `json:"delete_time_in_millis"`
+	DeleteCurrent      float64  `json:"delete_current"`
+	NoopUpdateTotal    *float64 `json:"noop_update_total"`
+
+	ThrottleTimeInMillis float64 `json:"throttle_time_in_millis"`
+}
+
+type ElasticsearchNodeIndicesSearch struct {
+	QueryTotal        float64 `json:"query_total"`
+	QueryTimeInMillis float64 `json:"query_time_in_millis"`
+	QueryCurrent      float64 `json:"query_current"`
+	FetchTotal        float64 `json:"fetch_total"`
+	FetchTimeInMillis float64 `json:"fetch_time_in_millis"`
+	FetchCurrent      float64 `json:"fetch_current"`
+
+	OpenContexts       float64 `json:"open_contexts"`
+	ScrollTotal        float64 `json:"scroll_total"`
+	ScrollTimeInMillis float64 `json:"scroll_time_in_millis"`
+
+	// Suggest stats are missing on some old versions.
+	SuggestTotal        *float64 `json:"suggest_total"`
+	SuggestTimeInMillis *float64 `json:"suggest_time_in_millis"`
+	SuggestCurrent      *float64 `json:"suggest_current"`
+}
+
+type ElasticsearchNodeIndicesGet struct {
+	Total        float64 `json:"total"`
+	TimeInMillis float64 `json:"time_in_millis"`
+	ExistsTotal  float64 `json:"exists_total"`
+	MissingTotal float64 `json:"missing_total"`
+	Current      float64 `json:"current"`
+}
+
+type ElasticsearchNodeIndicesMerges struct {
+	Current            float64 `json:"current"`
+	CurrentDocs        float64 `json:"current_docs"`
+	CurrentSizeInBytes float64 `json:"current_size_in_bytes"`
+	Total              float64 `json:"total"`
+	TotalDocs          float64 `json:"total_docs"`
+	TotalSizeInBytes   float64 `json:"total_size_in_bytes"`
+	TotalTimeInMillis  float64 `json:"total_time_in_millis"`
+
+	TotalThrottledTimeInMillis float64 `json:"total_throttled_time_in_millis"`
+	// TotalAutoThrottleInBytes is the merge rate limit, summed over shards.
+	TotalAutoThrottleInBytes *float64 `json:"total_auto_throttle_in_bytes"`
+}
+
+type ElasticsearchNodeIndicesRefresh struct {
+	Total             float64 `json:"total"`
+	TotalTimeInMillis float64 `json:"total_time_in_millis"`
+	// The following are only reported by recent versions.
+	ExternalTotal             *float64 `json:"external_total"`
+	ExternalTotalTimeInMillis *float64 `json:"external_total_time_in_millis"`
+	Listeners                 *float64 `json:"listeners"`
+}
+
+type ElasticsearchNodeIndicesWarmer struct {
+	Current           float64 `json:"current"`
+	Total             float64 `json:"total"`
+	TotalTimeInMillis float64 `json:"total_time_in_millis"`
+}
+
+type ElasticsearchNodeIndicesQueryCache struct {
+	MemorySizeInBytes float64 `json:"memory_size_in_bytes"`
+	CacheSize         float64 `json:"cache_size"`
+	CacheCount        float64 `json:"cache_count"`
+	HitCount          float64 `json:"hit_count"`
+	MissCount         float64 `json:"miss_count"`
+	Evictions         float64 `json:"evictions"`
+}
+
+type ElasticsearchNodeIndicesFielddata struct {
+	MemorySizeInBytes float64 `json:"memory_size_in_bytes"`
+	Evictions         float64 `json:"evictions"`
+}
+
+type ElasticsearchNodeIndicesRequestCache struct {
+	MemorySizeInBytes float64 `json:"memory_size_in_bytes"`
+	Evictions         float64 `json:"evictions"`
+	HitCount          float64 `json:"hit_count"`
+	MissCount         float64 `json:"miss_count"`
+}
+
+type ElasticsearchNodeIndicesCompletion struct {
+	SizeInBytes float64 `json:"size_in_bytes"`
+}
+
+type ElasticsearchNodeIndicesTranslog struct {
+	Operations  float64 `json:"operations"`
+	SizeInBytes float64 `json:"size_in_bytes"`
+	// The following are only reported by recent versions.
+	UncommittedOperations   *float64 `json:"uncommitted_operations"`
+	UncommittedSizeInBytes  *float64 `json:"uncommitted_size_in_bytes"`
+	EarliestLastModifiedAge *float64 `json:"earliest_last_modified_age"`
+}
+
+type ElasticsearchNodeIndicesRecovery struct {
+	CurrentAsSource      float64 `json:"current_as_source"`
+	CurrentAsTarget      float64 `json:"current_as_target"`
+	ThrottleTimeInMillis float64 `json:"throttle_time_in_millis"`
+}
+
+type ElasticsearchNodeIndicesShardStats struct {
+	TotalCount float64 `json:"total_count"`
+}
+
+type ElasticsearchNodeIndicesMappings struct {
+	TotalCount                          *float64 `json:"total_count"`
+	TotalEstimatedOverheadInBytes       *float64 `json:"total_estimated_overhead_in_bytes"`
+	TotalDeduplicatedFieldCount         *float64 `json:"total_deduplicated_field_count"`
+	TotalDeduplicatedMappingSizeInBytes *float64 `json:"total_deduplicated_mapping_size_in_bytes"`
+}
+
+type ElasticsearchNodeIndicesBulk struct {
+	TotalOperations   float64 `json:"total_operations"`
+	TotalTimeInMillis float64 `json:"total_time_in_millis"`
+	TotalSizeInBytes  float64 `json:"total_size_in_bytes"`
+	AvgTimeInMillis   float64 `json:"avg_time_in_millis"`
+	AvgSizeInBytes    float64 `json:"avg_size_in_bytes"`
+}
+
+type ElasticsearchNodeIndicesDenseVector struct {
+	ValueCount float64 `json:"value_count"`
+}
+
+type ElasticsearchNodeIndicesFlush struct {
+	Total             float64  `json:"total"`
+	TotalTimeInMillis float64  `json:"total_time_in_millis"`
+	Periodic          *float64 `json:"periodic"`
+}
+
+type ElasticsearchNodeIndicesSegments struct {
+	Count         float64 `json:"count"`
+	MemoryInBytes float64 `json:"memory_in_bytes"`
+
+	VersionMapMemoryInBytes  *float64 `json:"version_map_memory_in_bytes"`
+	FixedBitSetMemoryInBytes *float64 `json:"fixed_bit_set_memory_in_bytes"`
+
+	TermsMemoryInBytes        *float64 `json:"terms_memory_in_bytes"`
+	StoredFieldsMemoryInBytes *float64 `json:"stored_fields_memory_in_bytes"`
+	TermVectorsMemoryInBytes  *float64 `json:"term_vectors_memory_in_bytes"`
+	NormsMemoryInBytes        *float64 `json:"norms_memory_in_bytes"`
+	PointsMemoryInBytes       *float64 `json:"points_memory_in_bytes"`
+	DocValuesMemoryInBytes    *float64 `json:"doc_values_memory_in_bytes"`
+	IndexWriterMemoryInBytes  *float64 `json:"index_writer_memory_in_bytes"`
+}
+
+// addBreakdownStats adds the memory used by each part of the segments that
+// is reported. From Elasticsearch 8 (major) on, only the index writer is
+// left, as the other parts are kept off heap and always reported as 0.
+func (segments ElasticsearchNodeIndicesSegments) addBreakdownStats(nodeStats map[string]float64, major int) {
+	parts := map[string]*float64{
+		"index_writer": segments.IndexWriterMemoryInBytes,
+	}
+	if major < 8 {
+		parts["terms"] = segments.TermsMemoryInBytes
+		parts["stored_fields"] = segments.StoredFieldsMemoryInBytes
+		parts["term_vectors"] = segments.TermVectorsMemoryInBytes
+		parts["norms"] = segments.NormsMemoryInBytes
+		parts["points"] = segments.PointsMemoryInBytes
+		parts["doc_values"] = segments.DocValuesMemoryInBytes
+	}
+	for key, value := range parts {
+		if value != nil {
+			nodeStats["indices_segments_"+key+"_memory_in_bytes"] = *value
+		}
+	}
+}
+
+func (indices ElasticsearchNodeIndices) addStats(nodeStats map[string]float64) {
+	nodeStats["indices_docs_count"] = indices.Docs.Count
+	nodeStats["indices_docs_deleted"] = indices.Docs.Deleted
+	nodeStats["indices_store_size_in_bytes"] = indices.Store.SizeInBytes
+	if indices.Store.ReservedInBytes != nil {
+		nodeStats["indices_store_reserved_in_bytes"] = *indices.Store.ReservedInBytes
+	}
+	nodeStats["indices_indexing_index_total"] = indices.Indexing.IndexTotal
+	nodeStats["indices_indexing_index_time_in_millis"] = indices.Indexing.IndexTimeInMillis
+	nodeStats["indices_indexing_index_current"] = indices.Indexing.IndexCurrent
+	nodeStats["indices_indexing_index_failed"] = indices.Indexing.IndexFailed
+	nodeStats["indices_indexing_delete_total"] = indices.Indexing.DeleteTotal
+	nodeStats["indices_indexing_delete_time_in_millis"] = indices.Indexing.DeleteTimeInMillis
+	nodeStats["indices_indexing_delete_current"] = indices.Indexing.DeleteCurrent
+	if indices.Indexing.NoopUpdateTotal != nil {
+		nodeStats["indices_indexing_noop_update_total"] = *indices.Indexing.NoopUpdateTotal
+	}
+	nodeStats["indices_indexing_throttle_time_in_millis"] = indices.Indexing.ThrottleTimeInMillis
+	nodeStats["indices_search_query_total"] = indices.Search.QueryTotal
+	nodeStats["indices_search_query_time_in_millis"] = indices.Search.QueryTimeInMillis
+	nodeStats["indices_search_query_current"] = indices.Search.QueryCurrent
+	nodeStats["indices_search_fetch_total"] = indices.Search.FetchTotal
+	nodeStats["indices_search_fetch_time_in_millis"] = indices.Search.FetchTimeInMillis
+	nodeStats["indices_search_fetch_current"] = indices.Search.FetchCurrent
+	nodeStats["indices_search_open_contexts"] = indices.Search.OpenContexts
+	nodeStats["indices_search_scroll_total"] = indices.Search.ScrollTotal
+	nodeStats["indices_search_scroll_time_in_millis"] = indices.Search.ScrollTimeInMillis
+	if indices.Search.SuggestTotal != nil {
+		nodeStats["indices_search_suggest_total"] = *indices.Search.SuggestTotal
+	}
+	if indices.Search.SuggestTimeInMillis != nil {
+		nodeStats["indices_search_suggest_time_in_millis"] = *indices.Search.SuggestTimeInMillis
+	}
+	if indices.Search.SuggestCurrent != nil {
+		nodeStats["indices_search_suggest_current"] = *indices.Search.SuggestCurrent
+	}
+	nodeStats["indices_get_total"] = indices.Get.Total
+	nodeStats["indices_get_time_in_millis"] = indices.Get.TimeInMillis
+	nodeStats["indices_get_exists_total"] = indices.Get.ExistsTotal
+	nodeStats["indices_get_missing_total"] = indices.Get.MissingTotal
+	nodeStats["indices_get_current"] = indices.Get.Current
+	nodeStats["indices_merges_current"] = indices.Merges.Current
+	nodeStats["indices_merges_current_docs"] = indices.Merges.CurrentDocs
+	nodeStats["indices_merges_current_size_in_bytes"] = indices.Merges.CurrentSizeInBytes
+	nodeStats["indices_merges_total"] = indices.Merges.Total
+	nodeStats["indices_merges_total_docs"] = indices.Merges.TotalDocs
+	nodeStats["indices_merges_total_size_in_bytes"] = indices.Merges.TotalSizeInBytes
+	nodeStats["indices_merges_total_time_in_millis"] = indices.Merges.TotalTimeInMillis
+	nodeStats["indices_merges_total_throttled_time_in_millis"] = indices.Merges.TotalThrottledTimeInMillis
+	if indices.Merges.TotalAutoThrottleInBytes != nil {
+		nodeStats["indices_merges_total_auto_throttle_in_bytes"] = *indices.Merges.TotalAutoThrottleInBytes
+	}
+	nodeStats["indices_refresh_total"] = indices.Refresh.Total
+	nodeStats["indices_refresh_total_time_in_millis"] = indices.Refresh.TotalTimeInMillis
+	if indices.Refresh.ExternalTotal != nil {
+		nodeStats["indices_refresh_external_total"] = *indices.Refresh.ExternalTotal
+	}
+	if indices.Refresh.ExternalTotalTimeInMillis != nil {
+		nodeStats["indices_refresh_external_total_time_in_millis"] = *indices.Refresh.ExternalTotalTimeInMillis
+	}
+	if indices.Refresh.Listeners != nil {
+		nodeStats["indices_refresh_listeners"] = *indices.Refresh.Listeners
+	}
+	nodeStats["indices_warmer_current"] = indices.Warmer.Current
+	nodeStats["indices_warmer_total"] = indices.Warmer.Total
+	nodeStats["indices_warmer_total_time_in_millis"] = indices.Warmer.TotalTimeInMillis
+	if queryCache := indices.QueryCache; queryCache != nil {
+		nodeStats["indices_query_cache_memory_size_in_bytes"] = queryCache.MemorySizeInBytes
+		nodeStats["indices_query_cache_cache_size"] = queryCache.CacheSize
+		nodeStats["indices_query_cache_cache_count"] = queryCache.CacheCount
+		nodeStats["indices_query_cache_hit_count"] = queryCache.HitCount
+		nodeStats["indices_query_cache_miss_count"] = queryCache.MissCount
+		nodeStats["indices_query_cache_evictions"] = queryCache.Evictions
+	}
+	nodeStats["indices_fielddata_memory_size_in_bytes"] = indices.Fielddata.MemorySizeInBytes
+	nodeStats["indices_fielddata_evictions"] = indices.Fielddata.Evictions
+	if requestCache := indices.RequestCache; requestCache != nil {
+		nodeStats["indices_request_cache_memory_size_in_bytes"] = requestCache.MemorySizeInBytes
+		nodeStats["indices_request_cache_evictions"] = requestCache.Evictions
+		nodeStats["indices_request_cache_hit_count"] = requestCache.HitCount
+		nodeStats["indices_request_cache_miss_count"] = requestCache.MissCount
+	}
+	nodeStats["indices_completion_size_in_bytes"] = indices.Completion.SizeInBytes
+	translog := indices.Translog
+	nodeStats["indices_translog_operations"] = translog.Operations
+	nodeStats["indices_translog_size_in_bytes"] = translog.SizeInBytes
+	if translog.UncommittedOperations != nil {
+		nodeStats["indices_translog_uncommitted_operations"] = *translog.UncommittedOperations
+	}
+	if translog.UncommittedSizeInBytes != nil {
+		nodeStats["indices_translog_uncommitted_size_in_bytes"] = *translog.UncommittedSizeInBytes
+	}
+	if translog.EarliestLastModifiedAge != nil {
+		nodeStats["indices_translog_earliest_last_modified_age"] = *translog.EarliestLastModifiedAge
+	}
+	if recovery := indices.Recovery; recovery != nil {
+		nodeStats["indices_recovery_current_as_source"] = recovery.CurrentAsSource
+		nodeStats["indices_recovery_current_as_target"] = recovery.CurrentAsTarget
+		nodeStats["indices_recovery_throttle_time_in_millis"] = recovery.ThrottleTimeInMillis
+	}
+	if indices.ShardStats != nil {
+		nodeStats["indices_shard_stats_total_count"] = indices.ShardStats.TotalCount
+	}
+	if mappings := indices.Mappings; mappings != nil {
+		for key, value := range map[string]*float64{
+			"total_count":                              mappings.TotalCount,
+			"total_estimated_overhead_in_bytes":        mappings.TotalEstimatedOverheadInBytes,
+			"total_deduplicated_field_count":           mappings.TotalDeduplicatedFieldCount,
+			"total_deduplicated_mapping_size_in_bytes": mappings.TotalDeduplicatedMappingSizeInBytes,
+		} {
+			if value != nil {
+				nodeStats["indices_mappings_"+key] = *value
+			}
+		}
+	}
+	if bulk := indices.Bulk; bulk != nil {
+		nodeStats["indices_bulk_total_operations"] = bulk.TotalOperations
+		nodeStats["indices_bulk_total_time_in_millis"] = bulk.TotalTimeInMillis
+		nodeStats["indices_bulk_total_size_in_bytes"] = bulk.TotalSizeInBytes
+		nodeStats["indices_bulk_avg_time_in_millis"] = bulk.AvgTimeInMillis
+		nodeStats["indices_bulk_avg_size_in_bytes"] = bulk.AvgSizeInBytes
+	}
+	if indices.DenseVector != nil {
+		nodeStats["indices_dense_vector_value_count"] = indices.DenseVector.ValueCount
+	}
+	nodeStats["indices_flush_total"] = indices.Flush.Total
+	nodeStats["indices_flush_total_time_in_millis"] = indices.Flush.TotalTimeInMillis
+	if indices.Flush.Periodic != nil {
+		nodeStats["indices_flush_periodic_total"] = *indices.Flush.Periodic
+	}
+	segments := indices.Segments
+	nodeStats["indices_segments_count"] = segments.Count
+	nodeStats["indices_segments_memory_in_bytes"] = segments.MemoryInBytes
+	if segments.VersionMapMemoryInBytes != nil {
+		nodeStats["indices_segments_version_map_memory_in_bytes"] = *segments.VersionMapMemoryInBytes
+	}
+	if segments.FixedBitSetMemoryInBytes != nil {
+		nodeStats["indices_segments_fixed_bit_set_memory_in_bytes"] = *segments.FixedBitSetMemoryInBytes
+	}
+}
+
+func (tp ElasticsearchNodeInfoThreadPool) queueSize() (float64, bool) {
+	switch size := tp.QueueSize.(type) {
+	case float64:
+		return size, true
+	case string:
+		scale := 1.0
+		if strings.HasSuffix(size, "k") {
+			size, scale = strings.TrimSuffix(size, "k"), 1000
+		}
+		n, err := strconv.ParseFloat(size, 64)
+		return n * scale, err == nil
+	}
+
+	return 0, false
+}
+
+type ElasticsearchNodeThreadPool struct {
+	Threads   float64 `json:"threads"`
+	Queue     float64 `json:"queue"`
+	Active    float64 `json:"active"`
+	Rejected  float64 `json:"rejected"`
+	Largest   float64 `json:"largest"`
+	Completed float64 `json:"completed"`
+}
+
+type ElasticsearchNodeBreaker struct {
+	EstimatedSizeInBytes float64 `json:"estimated_size_in_bytes"`
+	LimitSizeInBytes     float64 `json:"limit_size_in_bytes"`
+	Tripped              float64 `json:"tripped"`
+}
+
+type ElasticsearchNodeTransport struct {
+	ServerOpen    float64 `json:"server_open"`
+	RxCount       float64 `json:"rx_count"`
+	RxSizeInBytes float64 `json:"rx_size_in_bytes"`
+	TxCount       float64 `json:"tx_count"`
+	TxSizeInBytes float64 `json:"tx_size_in_bytes"`
+
+	// The following are only reported by recent versions.
+	TotalOutboundConnections      *float64                                    `json:"total_outbound_connections"`
+	InboundHandlingTimeHistogram  []ElasticsearchNodeTransportHistogramBucket `json:"inbound_handling_time_histogram"`
+	OutboundHandlingTimeHistogram []ElasticsearchNodeTransportHistogramBucket `json:"outbound_handling_time_histogram"`
+}
+
+type ElasticsearchNodeTransportHistogramBucket struct {
+	GeMillis float64 `json:"ge_millis"`
+	Count    float64 `json:"count"`
+}
+
+// slowHandlingThresholdMillis is where handling time histogram buckets
+// start to count as slow.
+const slowHandlingThresholdMillis = 1000
+
+// slowCount returns the number of requests in buckets of at least
+// slowHandlingThresholdMillis.
+func slowCount(histogram []ElasticsearchNodeTransportHistogramBucket) float64 {
+	count := 0.0
+	for _, bucket := range histogram {
+		if bucket.GeMillis >= slowHandlingThresholdMillis {
+			count += bucket.Count
+		}
+	}
+
+	return count
+}
+
+func (transport ElasticsearchNodeTransport) addStats(nodeStats map[string]float64) {
+	nodeStats["transport_server_open"] = transport.ServerOpen
+	nodeStats["transport_rx_count"] = transport.RxCount
+	nodeStats["transport_rx_size_in_bytes"] = transport.RxSizeInBytes
+	nodeStats["transport_tx_count"] = transport.TxCount
+	nodeStats["transport_tx_size_in_bytes"] = transport.TxSizeInBytes
+	if transport.TotalOutboundConnections != nil {
+		nodeStats["transport_total_outbound_connections"] = *transport.TotalOutboundConnections
+	}
+	if transport.InboundHandlingTimeHistogram != nil {
+		nodeStats["transport_inbound_handling_time_slow_count"] = slowCount(transport.InboundHandlingTimeHistogram)
+	}
+	if transport.OutboundHandlingTimeHistogram != nil {
+		nodeStats["transport_outbound_handling_time_slow_count"] = slowCount(transport.OutboundHandlingTimeHistogram)
+	}
+}
+
+type ElasticsearchNodeHttp struct {
+	CurrentOpen float64 `json:"current_open"`
+	TotalOpened float64 `json:"total_opened"`
+	// Clients is only reported by Elasticsearch 7.13 and later.
+	Clients []ElasticsearchNodeHttpClient
+}
+
+type ElasticsearchNodeHttpClient struct {
+	RequestCount float64 `json:"request_count"`
+}
+
+type ElasticsearchNodeScript struct {
+	Compilations   float64 `json:"compilations"`
+	CacheEvictions float64 `json:"cache_evictions"`
+	// CompilationLimitTriggered is only reported by Elasticsearch 7.0 and
+	// later.
+	CompilationLimitTriggered *float64 `json:"compilation_limit_triggered"`
+}
+
+type ElasticsearchNodeScriptCache struct {
+	Contexts []ElasticsearchNodeScriptCacheContext
+}
+
+type ElasticsearchNodeScriptCacheContext struct {
+	Context                   string  `json:"context"`
+	Compilations              float64 `json:"compilations"`
+	CacheEvictions            float64 `json:"cache_evictions"`
+	CompilationLimitTriggered float64 `json:"compilation_limit_triggered"`
+}
+
+type ElasticsearchNodeIngest struct {
+	Total     ElasticsearchNodeIngestStats
+	Pipelines map[string]ElasticsearchNodeIngestStats
+}
+
+type ElasticsearchNodeIngestStats struct {
+	Count        float64 `json:"count"`
+	TimeInMillis float64 `json:"time_in_millis"`
+	Current      float64 `json:"current"`
+	Failed       float64 `json:"failed"`
+}
+
+func (ingest ElasticsearchNodeIngestStats) addStats(nodeStats map[string]float64, prefix string) {
+	nodeStats[prefix+"_count"] = ingest.Count
+	nodeStats[prefix+"_time_in_millis"] = ingest.TimeInMillis
+	nodeStats[prefix+"_current"] = ingest.Current
+	nodeStats[prefix+"_failed"] = ingest.Failed
+}
+
+// ElasticsearchNodeDiscovery holds discovery stats, most of which are only
+// reported by some versions.
+type ElasticsearchNodeDiscovery struct {
+	ClusterStateQueue   *ElasticsearchNodeDiscoveryClusterStateQueue            `json:"cluster_state_queue"`
+	ClusterStateUpdate  map[string]ElasticsearchNodeDiscoveryClusterStateUpdate `json:"cluster_state_update"`
+	ClusterApplierStats *ElasticsearchNodeDiscoveryClusterApplierStats          `json:"cluster_applier_stats"`
+
+	PublishedClusterStates  *ElasticsearchNodeDiscoveryPublishedClusterStates  `json:"published_cluster_states"`
+	SerializedClusterStates *ElasticsearchNodeDiscoverySerializedClusterStates `json:"serialized_cluster_states"`
+}
+
+type ElasticsearchNodeDiscoveryPublishedClusterStates struct {
+	FullStates        float64 `json:"full_states"`
+	IncompatibleDiffs float64 `json:"incompatible_diffs"`
+	CompatibleDiffs   float64 `json:"compatible_diffs"`
+}
+
+type ElasticsearchNodeDiscoverySerializedClusterStates struct {
+	FullStates ElasticsearchNodeDiscoverySerializedClusterStatesStats `json:"full_states"`
+	Diffs      ElasticsearchNodeDiscoverySerializedClusterStatesStats `json:"diffs"`
+}
+
+type ElasticsearchNodeDiscoverySerializedClusterStatesStats struct {
+	Count float64 `json:"count"`
+}
+
+type ElasticsearchNodeDiscoveryClusterStateQueue struct {
+	Total     float64 `json:"total"`
+	Pending   float64 `json:"pending"`
+	Committed float64 `json:"committed"`
+}
+
+type ElasticsearchNodeDiscoveryClusterStateUpdate struct {
+	Count float64 `json:"count"`
+}
+
+type ElasticsearchNodeDiscoveryClusterApplierStats struct {
+	Recordings []ElasticsearchNodeDiscoveryClusterApplierRecording
+}
+
+type ElasticsearchNodeDiscoveryClusterApplierRecording struct {
+	CumulativeExecutionCount      float64 `json:"cumulative_execution_count"`
+	CumulativeExecutionTimeMillis float64 `json:"cumulative_execution_time_millis"`
+}
+
+func (discovery ElasticsearchNodeDiscovery) addStats(nodeStats map[string]float64) {
+	if queue := discovery.ClusterStateQueue; queue != nil {
+		nodeStats["discovery_cluster_state_queue_total"] = queue.Total
+		nodeStats["discovery_cluster_state_queue_pending"] = queue.Pending
+		nodeStats["discovery_cluster_state_queue_committed"] = queue.Committed
+	}
+	// Updates are reported per outcome (success, failure, unchanged).
+	for outcome, update := range discovery.ClusterStateUpdate {
+		nodeStats["discovery_cluster_state_update_"+sanitizeMetricName(outcome)+"_count"] = update.Count
+	}
+	if applier := discovery.ClusterApplierStats; applier != nil {
+		count, millis := 0.0, 0.0
+		for _, recording := range applier.Recordings {
+			count += recording.CumulativeExecutionCount
+			millis += recording.CumulativeExecutionTimeMillis
+		}
+		nodeStats["discovery_cluster_applier_execution_count"] = count
+		nodeStats["discovery_cluster_applier_execution_time_millis"] = millis
+	}
+	if published := discovery.PublishedClusterStates; published != nil {
+		nodeStats["discovery_published_cluster_states_full_states"] = published.FullStates
+		nodeStats["discovery_published_cluster_states_incompatible_diffs"] = published.IncompatibleDiffs
+		nodeStats["discovery_published_cluster_states_compatible_diffs"] = published.CompatibleDiffs
+	}
+	if serialized := discovery.SerializedClusterStates; serialized != nil {
+		nodeStats["discovery_serialized_cluster_states_full_states_count"] = serialized.FullStates.Count
+		nodeStats["discovery_serialized_cluster_states_diffs_count"] = serialized.Diffs.Count
+	}
+}
+
+// ElasticsearchNodeAdaptiveSelection holds values that are missing until
+// the node has searched the target, and rank is reported as a string.
+type ElasticsearchNodeAdaptiveSelection struct {
+	AvgQueueSize      interface{} `json:"avg_queue_size"`
+	AvgServiceTimeNs  interface{} `json:"avg_service_time_ns"`
+	AvgResponseTimeNs interface{} `json:"avg_response_time_ns"`
+	Rank              interface{} `json:"rank"`
+}
+
+func (as ElasticsearchNodeAdaptiveSelection) values() map[string]interface{} {
+	return map[string]interface{}{
+		"avg_queue_size":       as.AvgQueueSize,
+		"avg_service_time_ns":  as.AvgServiceTimeNs,
+		"avg_response_time_ns": as.AvgResponseTimeNs,
+		"rank":                 as.Rank,
+	}
+}
+
+type ElasticsearchNodeIndexingPressure struct {
+	Memory ElasticsearchNodeIndexingPressureMemory
+}
+
+type ElasticsearchNodeIndexingPressureMemory struct {
+	Current      ElasticsearchNodeIndexingPressureMemoryCurrent
+	Total        ElasticsearchNodeIndexingPressureMemoryTotal
+	LimitInBytes *float64 `json:"limit_in_bytes"`
+}
+
+type ElasticsearchNodeIndexingPressureMemoryCurrent struct {
+	CombinedCoordinatingAndPrimaryInBytes float64 `json:"combined_coordinating_and_primary_in_bytes"`
+	CoordinatingInBytes                   float64 `json:"coordinating_in_bytes"`
+	PrimaryInBytes                        float64 `json:"primary_in_bytes"`
+	ReplicaInBytes                        float64 `json:"replica_in_bytes"`
+}
+
+type ElasticsearchNodeIndexingPressureMemoryTotal struct {
+	CombinedCoordinatingAndPrimaryInBytes float64 `json:"combined_coordinating_and_primary_in_bytes"`
+	CoordinatingInBytes                   float64 `json:"coordinating_in_bytes"`
+	PrimaryInBytes                        float64 `json:"primary_in_bytes"`
+	ReplicaInBytes                        float64 `json:"replica_in_bytes"`
+
+	CoordinatingRejections float64 `json:"coordinating_rejections"`
+	PrimaryRejections      float64 `json:"primary_rejections"`
+	ReplicaRejections      float64 `json:"replica_rejections"`
+}
+
+func (ip ElasticsearchNodeIndexingPressure) addStats(nodeStats map[string]float64) {
+	current, total := ip.Memory.Current, ip.Memory.Total
+	nodeStats["indexing_pressure_current_bytes"] = current.CombinedCoordinatingAndPrimaryInBytes
+	nodeStats["indexing_pressure_current_coordinating_bytes"] = current.CoordinatingInBytes
+	nodeStats["indexing_pressure_current_primary_bytes"] = current.PrimaryInBytes
+	nodeStats["indexing_pressure_current_replica_bytes"] = current.ReplicaInBytes
+	if ip.Memory.LimitInBytes != nil {
+		nodeStats["indexing_pressure_limit_bytes"] = *ip.Memory.LimitInBytes
+	}
+	nodeStats["indexing_pressure_total_bytes"] = total.CombinedCoordinatingAndPrimaryInBytes
+	nodeStats["indexing_pressure_total_coordinating_bytes"] = total.CoordinatingInBytes
+	nodeStats["indexing_pressure_total_primary_bytes"] = total.PrimaryInBytes
+	nodeStats["indexing_pressure_total_replica_bytes"] = total.ReplicaInBytes
+	nodeStats["indexing_pressure_coordinating_rejections"] = total.CoordinatingRejections
+	nodeStats["indexing_pressure_primary_rejections"] = total.PrimaryRejections
+	nodeStats["indexing_pressure_replica_rejections"] = total.ReplicaRejections
+	nodeStats["indexing_pressure_rejections"] = total.CoordinatingRejections +
+		total.PrimaryRejections + total.ReplicaRejections
+}
+
+// requestTimings records when the phases of an HTTP request happened.
+type requestTimings struct {
+	start        time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	firstByte    time.Time
+}
+
+func (t *requestTimings) clientTrace() *httptrace.ClientTrace {
+	t.start = time.Now()
+	return &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			t.connectStart = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.connectDone = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			t.firstByte = time.Now()
+		},
+	}
+}
+
+func (p *ElasticsearchNodesPlugin) getJSON(path string, v interface{}, trace *httptrace.ClientTrace) error {
+	req, err := http.NewRequest("GET", p.URI+path, nil)
+	if err != nil {
+		return err
+	}
+	if trace != nil {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -70,88 +1166,1296 @@ func (p *ElasticsearchNodesPlugin) loadStats() error {
 		return err
 	}
 
+	return json.Unmarshal(body, v)
+}
+
+func (p *ElasticsearchNodesPlugin) loadStats() error {
 	var cluster ElasticsearchCluster
-	err = json.Unmarshal(body, &cluster)
+	var timings requestTimings
+	err := p.getJSON("/_nodes/stats", &cluster, timings.clientTrace())
+	if _, ok := err.(*json.SyntaxError); ok {
+		// A body truncated on the way usually decodes fine when fetched
+		// again. Type errors mean the schema itself is off and are not
+		// retried.
+		cluster = ElasticsearchCluster{}
+		timings = requestTimings{}
+		err = p.getJSON("/_nodes/stats", &cluster, timings.clientTrace())
+	}
 	if err != nil {
 		return err
 	}
 
+	if p.ExpectCluster != "" && cluster.ClusterName != p.ExpectCluster {
+		return fmt.Errorf("cluster name is %q, expected %q", cluster.ClusterName, p.ExpectCluster)
+	}
+
+	if p.NodeAttr != "" {
+		cluster.Nodes, err = selectNodeByAttr(cluster.Nodes, p.NodeAttr)
+		if err != nil {
+			return err
+		}
+	}
+
+	state, err := loadState(p.StateFile)
+	if err != nil {
+		log.Printf("failed to load state: %s", err)
+	}
+	state.Run++
+
+	// Versions, thread pool queue sizes, allocated processors and indexing
+	// buffers are not part of node stats, so they are looked up in node
+	// info. As they only change when a node restarts, node info is kept in
+	// the state file and fetched again only for a new or restarted node.
+	var info ElasticsearchNodesInfo
+	if state.NodeInfo != nil {
+		info = *state.NodeInfo
+	}
+	if state.NodeInfo == nil || nodeInfoStale(info, cluster.Nodes, state) {
+		var fresh ElasticsearchNodesInfo
+		err = p.getJSON("/_nodes?filter_path=nodes.*.version,nodes.*.thread_pool.*.queue_size,nodes.*.os.allocated_processors,nodes.*.total_indexing_buffer", &fresh, nil)
+		if err != nil {
+			// The stale copy is still better than nothing for this run,
+			// but is not kept so that the next run tries again.
+			log.Printf("failed to fetch node info: %s", err)
+			state.NodeInfo = nil
+		} else {
+			info = fresh
+			state.NodeInfo = &fresh
+		}
+	}
+
 	stats := make(map[string]map[string]float64)
-	for _, node := range cluster.Nodes {
-		fs_total_in_bytes := node.Fs.Total.TotalInBytes
-		fs_free_in_bytes := node.Fs.Total.FreeInBytes
-		disk_used_in_bytes := fs_total_in_bytes - fs_free_in_bytes
+	clusterStats := make(map[string]float64)
+	roleGroups := make(map[string]string)
+	labels := make(map[string]map[string]string)
+	// A retried request may reuse the connection and never connect.
+	if !timings.connectDone.IsZero() {
+		clusterStats["plugin_connect_ms"] = milliseconds(timings.connectDone.Sub(timings.connectStart))
+	}
+	if !timings.firstByte.IsZero() {
+		clusterStats["plugin_ttfb_ms"] = milliseconds(timings.firstByte.Sub(timings.start))
+	}
+	if header := cluster.NodesHeader; header != nil {
+		clusterStats["cluster_nodes_total"] = header.Total
+		clusterStats["cluster_nodes_successful"] = header.Successful
+		clusterStats["cluster_nodes_failed"] = header.Failed
+	}
+	for nodeID, node := range cluster.Nodes {
+		ns := state.node(node.Name)
+		ns.Raw["jvm_uptime_in_millis"] = node.Jvm.UptimeInMillis
+		// Milliseconds since the node's previous sample
+		elapsed, elapsedOK := ns.delta("timestamp", node.Timestamp)
 
 		nodeStats := make(map[string]float64)
-		nodeStats["os_load_average"] = node.Os.LoadAverage
-		nodeStats["process_cpu_percent"] = node.Process.Cpu.Percent
-		nodeStats["jvm_mem_heap_used_in_bytes"] = node.Jvm.Mem.HeapUsedInBytes
-		nodeStats["disk_used_in_bytes"] = disk_used_in_bytes
+		node.Os.addStats(nodeStats)
+		if processors := info.Nodes[nodeID].Os.AllocatedProcessors; processors > 0 {
+			ns.Raw["os_allocated_processors"] = processors
+		}
+		if load, ok := nodeStats["os_load_average_1m"]; ok && ns.Raw["os_allocated_processors"] > 0 {
+			nodeStats["os_load_average_per_core"] = load / ns.Raw["os_allocated_processors"]
+		}
+		node.Process.addStats(nodeStats)
+		node.Jvm.addStats(nodeStats)
+		// Share of wall time spent in GC, clamped as the collectors' times
+		// may overlap.
+		gcTime := 0.0
+		for _, collector := range node.Jvm.Gc.Collectors {
+			gcTime += collector.CollectionTimeInMillis
+		}
+		if gcDelta, ok := ns.delta("jvm_gc_collection_time_in_millis", gcTime); ok && elapsedOK && elapsed > 0 {
+			nodeStats["jvm_gc_overhead_percent"] = math.Min(gcDelta/elapsed*100, 100)
+		}
+		// CPU time used by the node's cgroup as a share of one CPU.
+		if cgroup := node.Os.Cgroup; cgroup != nil && cgroup.Cpuacct != nil {
+			if usageDelta, ok := ns.delta("os_cgroup_cpuacct_usage_nanos", cgroup.Cpuacct.UsageNanos); ok && elapsedOK && elapsed > 0 {
+				nodeStats["os_cgroup_cpuacct_usage_percent"] = usageDelta / (elapsed * 1e6) * 100
+			}
+		}
+		if node.Fs != nil {
+			node.Fs.addStats(nodeStats)
+			if p.DataPaths {
+				for _, data := range node.Fs.Data {
+					data.addStats(nodeStats)
+				}
+			}
+			clusterStats["cluster_capacity_disk_total_in_bytes"] += node.Fs.Total.TotalInBytes
+			clusterStats["cluster_capacity_disk_used_in_bytes"] += nodeStats["disk_used_in_bytes"]
+		}
+		clusterStats["cluster_capacity_jvm_mem_heap_max_in_bytes"] += nodeStats["jvm_mem_heap_max_in_bytes"]
+		clusterStats["cluster_capacity_jvm_mem_heap_used_in_bytes"] += nodeStats["jvm_mem_heap_used_in_bytes"]
+		node.Indices.addStats(nodeStats)
+		if buffer := info.Nodes[nodeID].TotalIndexingBuffer; buffer > 0 {
+			ns.Raw["total_indexing_buffer"] = buffer
+		}
+		if buffer, ok := ns.Raw["total_indexing_buffer"]; ok {
+			nodeStats["total_indexing_buffer_in_bytes"] = buffer
+		}
+		// Average latencies over the interval
+		search, indexing := node.Indices.Search, node.Indices.Indexing
+		if latency, ok := ns.ratio("indices_search_query_time_in_millis", search.QueryTimeInMillis, "indices_search_query_total", search.QueryTotal); ok {
+			nodeStats["indices_search_query_latency_in_millis"] = latency
+		}
+		if latency, ok := ns.ratio("indices_indexing_index_time_in_millis", indexing.IndexTimeInMillis, "indices_indexing_index_total", indexing.IndexTotal); ok {
+			nodeStats["indices_indexing_index_latency_in_millis"] = latency
+		}
+		// Bytes merged per second since the node's previous sample
+		if mergedDelta, ok := ns.delta("indices_merges_total_size_in_bytes", node.Indices.Merges.TotalSizeInBytes); ok && elapsedOK && elapsed > 0 {
+			nodeStats["indices_merges_throughput_bytes_per_sec"] = mergedDelta / (elapsed / 1000)
+		}
+		// Cache hit ratios over the interval
+		if qc := node.Indices.QueryCache; qc != nil {
+			if ratio, ok := ns.ratio("indices_query_cache_hit_count", qc.HitCount, "indices_query_cache_lookup_count", qc.HitCount+qc.MissCount); ok {
+				nodeStats["indices_query_cache_hit_percent"] = ratio * 100
+			}
+		}
+		if rc := node.Indices.RequestCache; rc != nil {
+			if ratio, ok := ns.ratio("indices_request_cache_hit_count", rc.HitCount, "indices_request_cache_lookup_count", rc.HitCount+rc.MissCount); ok {
+				nodeStats["indices_request_cache_hit_percent"] = ratio * 100
+			}
+		}
+		// The major version is kept, as node info is not always at hand.
+		if major := majorVersion(info.Nodes[nodeID].Version); major > 0 {
+			ns.Raw["version_major"] = float64(major)
+		}
+		if p.SegmentsMemory {
+			node.Indices.Segments.addBreakdownStats(nodeStats, int(ns.Raw["version_major"]))
+		}
+		// The version is part of the key rather than only the label, so a
+		// node that has been upgraded shows up without redefining graphs.
+		if version := info.Nodes[nodeID].Version; version != "" {
+			key := "node_version_info_" + sanitizeMetricName(version)
+			nodeStats[key] = 1
+			labels[node.Name] = map[string]string{key: version}
+		}
+		// Pools differ between versions (bulk became write in 6.3), so
+		// whatever the node reports is taken as is.
+		for poolName, pool := range node.ThreadPool {
+			if p.ThreadPools != nil && !p.ThreadPools[poolName] {
+				continue
+			}
+			key := "threadpool_" + sanitizeMetricName(poolName)
+			nodeStats[key+"_active"] = pool.Active
+			nodeStats[key+"_threads"] = pool.Threads
+			nodeStats[key+"_rejected"] = pool.Rejected
+			nodeStats[key+"_largest"] = pool.Largest
+			nodeStats[key+"_completed"] = pool.Completed
+			nodeStats[key+"_queue"] = pool.Queue
+			capacity, ok := p.ThreadPoolQueueSizes[poolName]
+			if !ok {
+				capacity, ok = info.Nodes[nodeID].ThreadPool[poolName].queueSize()
+			}
+			if ok && capacity > 0 {
+				nodeStats[key+"_queue_percent"] = pool.Queue / capacity * 100
+			}
+		}
+		if node.Transport != nil {
+			node.Transport.addStats(nodeStats)
+		}
+		if node.Http != nil {
+			nodeStats["http_current_open"] = node.Http.CurrentOpen
+			nodeStats["http_total_opened"] = node.Http.TotalOpened
+			if p.HTTPClients && node.Http.Clients != nil {
+				requests := 0.0
+				for _, client := range node.Http.Clients {
+					requests += client.RequestCount
+				}
+				nodeStats["http_clients_count"] = float64(len(node.Http.Clients))
+				nodeStats["http_clients_request_count"] = requests
+			}
+		}
+		if script := node.Script; script != nil {
+			nodeStats["script_compilations"] = script.Compilations
+			nodeStats["script_cache_evictions"] = script.CacheEvictions
+			if script.CompilationLimitTriggered != nil {
+				nodeStats["script_compilation_limit_triggered"] = *script.CompilationLimitTriggered
+			}
+		}
+		if node.ScriptCache != nil {
+			for _, context := range node.ScriptCache.Contexts {
+				if !p.ScriptContexts[context.Context] {
+					continue
+				}
+				key := "script_context_" + sanitizeMetricName(context.Context)
+				nodeStats[key+"_compilations"] = context.Compilations
+				nodeStats[key+"_cache_evictions"] = context.CacheEvictions
+				nodeStats[key+"_compilation_limit_triggered"] = context.CompilationLimitTriggered
+			}
+		}
+		if node.Ingest != nil {
+			node.Ingest.Total.addStats(nodeStats, "ingest_total")
+			if p.IngestPipelines != nil {
+				for id, pipeline := range node.Ingest.Pipelines {
+					if p.IngestPipelines.MatchString(id) {
+						pipeline.addStats(nodeStats, "ingest_pipeline_"+sanitizeMetricName(id))
+					}
+				}
+			}
+		}
+		if node.Discovery != nil {
+			node.Discovery.addStats(nodeStats)
+		}
+		// Adaptive replica selection is reported for every pair of nodes,
+		// so it is reduced to the worst value over the targets unless the
+		// whole matrix is asked for.
+		if p.AdaptiveSelection || p.AdaptiveSelectionMatrix {
+			for targetID, target := range node.AdaptiveSelection {
+				targetName := targetID
+				if targetNode, ok := cluster.Nodes[targetID]; ok {
+					targetName = targetNode.Name
+				}
+				for field, v := range target.values() {
+					value, ok := numberValue(v)
+					if !ok {
+						continue
+					}
+					if p.AdaptiveSelection {
+						key := "adaptive_selection_max_" + field
+						if worst, ok := nodeStats[key]; !ok || value > worst {
+							nodeStats[key] = value
+						}
+					}
+					if p.AdaptiveSelectionMatrix {
+						nodeStats["adaptive_selection_node_"+sanitizeMetricName(targetName)+"_"+field] = value
+					}
+				}
+			}
+		}
+		for breakerName, breaker := range node.Breakers {
+			key := "breakers_" + sanitizeMetricName(breakerName)
+			nodeStats[key+"_estimated_size_in_bytes"] = breaker.EstimatedSizeInBytes
+			nodeStats[key+"_limit_size_in_bytes"] = breaker.LimitSizeInBytes
+			nodeStats[key+"_tripped"] = breaker.Tripped
+		}
+		// The old generation's peak usage only goes down when the JVM
+		// has been restarted.
+		if old, ok := node.Jvm.Mem.Pools["old"]; ok {
+			if last, ok := ns.Raw["jvm_mem_pools_old_peak_used_in_bytes"]; ok {
+				nodeStats["jvm_old_pool_peak_reset"] = 0
+				if old.PeakUsedInBytes < last {
+					nodeStats["jvm_old_pool_peak_reset"] = 1
+				}
+			}
+			ns.Raw["jvm_mem_pools_old_peak_used_in_bytes"] = old.PeakUsedInBytes
+		}
+		// indexing_pressure is only reported by Elasticsearch 7.9 and later.
+		if node.IndexingPressure != nil {
+			node.IndexingPressure.addStats(nodeStats)
+		}
 		stats[node.Name] = nodeStats
+
+		if p.PrefixByRole {
+			if role := primaryRole(node.Roles, p.RolePriority); role != "" {
+				roleGroups[node.Name] = strings.TrimPrefix(role, "data_")
+			}
+		}
+
+		if p.GroupByTier {
+			for _, tier := range nodeTiers(node.Roles) {
+				for _, key := range tierMetricKeys {
+					clusterStats["tier_"+tier+"_"+key] += nodeStats[key]
+				}
+			}
+		}
 	}
 	p.Stats = stats
+	p.ClusterStats = clusterStats
+	p.RoleGroups = roleGroups
+	p.Labels = labels
+
+	if p.DeltaNodes {
+		p.detectUnchangedNodes(state)
+	}
+	if p.StatePruneRuns > 0 {
+		state.prune(p.StatePruneRuns)
+	}
+	if !p.StateReadOnly {
+		err = state.save(p.StateFile)
+		if err != nil {
+			log.Printf("failed to save state: %s", err)
+		}
+	}
+
+	if p.MaxMetrics > 0 {
+		p.truncateMetrics()
+	}
 
 	return nil
 }
 
+// nodeInfoStale reports whether info lacks any of nodes or any of them has
+// restarted, going by its JVM uptime, since the previous run.
+func nodeInfoStale(info ElasticsearchNodesInfo, nodes map[string]ElasticsearchNode, state *pluginState) bool {
+	for nodeID, node := range nodes {
+		if _, ok := info.Nodes[nodeID]; !ok {
+			return true
+		}
+		ns, ok := state.Nodes[node.Name]
+		if !ok {
+			return true
+		}
+		if last, ok := ns.Raw["jvm_uptime_in_millis"]; !ok || node.Jvm.UptimeInMillis < last {
+			return true
+		}
+	}
+
+	return false
+}
+
+// truncateMetrics keeps the first metrics to be emitted, ordered lexically
+// by metric name, drops the rest and flags whether it did so in
+// plugin_metrics_truncated. At most MaxMetrics distinct metric names remain,
+// the flag included; a metric on two graphs still counts once.
+func (p *ElasticsearchNodesPlugin) truncateMetrics() {
+	names := []string{}
+	for nodeName, nodeStats := range p.Stats {
+		if p.Unchanged[nodeName] {
+			continue
+		}
+		for metricKey := range nodeStats {
+			names = append(names, nodeName+"_"+metricKey)
+		}
+	}
+	for metricKey := range p.ClusterStats {
+		names = append(names, metricKey)
+	}
+
+	truncated := 0.0
+	// One slot is kept for plugin_metrics_truncated itself.
+	if len(names) >= p.MaxMetrics {
+		sort.Strings(names)
+		dropped := make(map[string]bool)
+		for _, name := range names[p.MaxMetrics-1:] {
+			dropped[name] = true
+		}
+		for nodeName, nodeStats := range p.Stats {
+			for metricKey := range nodeStats {
+				if dropped[nodeName+"_"+metricKey] {
+					delete(nodeStats, metricKey)
+				}
+			}
+		}
+		for metricKey := range p.ClusterStats {
+			if dropped[metricKey] {
+				delete(p.ClusterStats, metricKey)
+			}
+		}
+		truncated = 1
+	}
+	p.ClusterStats["plugin_metrics_truncated"] = truncated
+}
+
+// selectNodeByAttr picks the single node whose attributes match attr, given
+// as key=value.
+func selectNodeByAttr(nodes map[string]ElasticsearchNode, attr string) (map[string]ElasticsearchNode, error) {
+	kv := strings.SplitN(attr, "=", 2)
+	if len(kv) != 2 {
+		return nil, fmt.Errorf("invalid node attribute %q, expected key=value", attr)
+	}
+
+	selected := make(map[string]ElasticsearchNode)
+	for nodeID, node := range nodes {
+		if value, ok := node.Attributes[kv[0]]; ok && value == kv[1] {
+			selected[nodeID] = node
+		}
+	}
+	if len(selected) != 1 {
+		return nil, fmt.Errorf("%d nodes have attribute %s, expected exactly one", len(selected), attr)
+	}
+
+	return selected, nil
+}
+
+// primaryRole returns the first role in priority the node has.
+func primaryRole(roles []string, priority []string) string {
+	for _, candidate := range priority {
+		for _, role := range roles {
+			if role == candidate {
+				return role
+			}
+		}
+	}
+
+	return ""
+}
+
+// tierMetricKeys are the node metrics summed per data tier in -group-by-tier
+// mode.
+var tierMetricKeys = []string{
+	"jvm_mem_heap_used_in_bytes",
+	"disk_used_in_bytes",
+}
+
+// nodeTiers returns the data tiers (hot, warm, cold, frozen, content) a node
+// belongs to according to its data_<tier> roles, with the generic data role
+// as a tier of its own. Nodes without a data role belong to none.
+func nodeTiers(roles []string) []string {
+	tiers := []string{}
+	for _, role := range roles {
+		switch {
+		case role == "data":
+			tiers = append(tiers, "data")
+		case strings.HasPrefix(role, "data_"):
+			tiers = append(tiers, strings.TrimPrefix(role, "data_"))
+		}
+	}
+
+	return tiers
+}
+
+// detectUnchangedNodes marks nodes whose gauges have not moved beyond
+// DeltaThreshold percent since they were last emitted, so FetchMetrics can
+// leave them out. Counters graphed as Diff are not compared, as their
+// lifetime totals hardly move in percent however busy the node is.
+func (p *ElasticsearchNodesPlugin) detectUnchangedNodes(state *pluginState) {
+	p.Unchanged = make(map[string]bool)
+	for nodeName, nodeStats := range p.Stats {
+		ns := state.Nodes[nodeName]
+		gauges := make(map[string]float64)
+		for metricKey, metricValue := range nodeStats {
+			if !diffMetric(metricKey) {
+				gauges[metricKey] = metricValue
+			}
+		}
+		if ns.Emitted != nil && !changedBeyond(ns.Emitted, gauges, p.DeltaThreshold) {
+			p.Unchanged[nodeName] = true
+			continue
+		}
+		ns.Emitted = gauges
+	}
+}
+
+// diffMetric reports whether the node metric key is graphed as Diff.
+func diffMetric(key string) bool {
+	for _, g := range graphDefs {
+		for _, m := range g.metrics {
+			if _, ok := m.match(key); ok && m.diff {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 // FetchMetrics interface for mackerelplugin
 func (p ElasticsearchNodesPlugin) FetchMetrics() (map[string]interface{}, error) {
 	stat := make(map[string]interface{})
 
 	for nodeName, v := range p.Stats {
+		if p.Unchanged[nodeName] {
+			continue
+		}
 		for metricKey, metricValue := range v {
 			stat[nodeName+"_"+metricKey] = metricValue
 		}
 	}
+	for metricKey, metricValue := range p.ClusterStats {
+		stat[metricKey] = metricValue
+	}
 
 	return stat, nil
 }
 
+// graphDef describes one graph. Each metric key is looked up in every
+// node's stats. A "*" in a key matches a name that varies per node (such as
+// a data path) and every match becomes a series of its own.
+type graphDef struct {
+	name    string
+	label   string
+	unit    string
+	metrics []metricDef
+}
+
+type metricDef struct {
+	key     string
+	label   string
+	diff    bool
+	stacked bool
+}
+
+var graphDefs = []graphDef{
+	{"OSLoadAverage", "Elasticsearch nodes OS Load Average", "float", []metricDef{
+		{key: "os_load_average_1m", label: "1m"},
+		{key: "os_load_average_5m", label: "5m"},
+		{key: "os_load_average_15m", label: "15m"},
+	}},
+	{"OSLoadAveragePerCore", "Elasticsearch nodes OS Load Average per Core", "float", []metricDef{
+		{key: "os_load_average_per_core", label: "1m"},
+	}},
+	{"OSCPUPercent", "Elasticsearch nodes OS CPU Percent", "percentage", []metricDef{
+		{key: "os_cpu_percent"},
+	}},
+	{"OSMem", "Elasticsearch nodes OS Memory", "bytes", []metricDef{
+		{key: "os_mem_used_in_bytes", label: "used", stacked: true},
+		{key: "os_mem_free_in_bytes", label: "free", stacked: true},
+		{key: "os_mem_total_in_bytes", label: "total"},
+	}},
+	{"OSSwap", "Elasticsearch nodes OS Swap", "bytes", []metricDef{
+		{key: "os_swap_used_in_bytes", label: "used"},
+		{key: "os_swap_free_in_bytes", label: "free"},
+		{key: "os_swap_total_in_bytes", label: "total"},
+	}},
+	{"OSCgroupCPUUsage", "Elasticsearch nodes Cgroup CPU Usage", "percentage", []metricDef{
+		{key: "os_cgroup_cpuacct_usage_percent"},
+	}},
+	{"OSCgroupCPUThrottled", "Elasticsearch nodes Cgroup CPU Throttled Count", "integer", []metricDef{
+		{key: "os_cgroup_cpu_stat_number_of_times_throttled", diff: true},
+	}},
+	{"OSCgroupCPUThrottledTime", "Elasticsearch nodes Cgroup CPU Throttled Time (ns)", "integer", []metricDef{
+		{key: "os_cgroup_cpu_stat_time_throttled_nanos", diff: true},
+	}},
+	{"OSCgroupMem", "Elasticsearch nodes Cgroup Memory", "bytes", []metricDef{
+		{key: "os_cgroup_memory_usage_in_bytes", label: "usage"},
+		{key: "os_cgroup_memory_limit_in_bytes", label: "limit"},
+	}},
+	{"OSCgroupMemUsagePercent", "Elasticsearch nodes Cgroup Memory Usage Percent", "percentage", []metricDef{
+		{key: "os_cgroup_memory_usage_percent"},
+	}},
+	{"OSMemUsedPercent", "Elasticsearch nodes OS Memory Used Percent", "percentage", []metricDef{
+		{key: "os_mem_used_percent"},
+	}},
+	{"ProcessCPUPercent", "Elasticsearch nodes Process CPU Percent", "percentage", []metricDef{
+		{key: "process_cpu_percent"},
+	}},
+	{"ProcessCPUTime", "Elasticsearch nodes Process CPU Time (ms)", "integer", []metricDef{
+		{key: "process_cpu_total_in_millis", diff: true},
+	}},
+	{"ProcessMemTotalVirtual", "Elasticsearch nodes Process Virtual Mem", "bytes", []metricDef{
+		{key: "process_mem_total_virtual_in_bytes"},
+	}},
+	{"ProcessFileDescriptors", "Elasticsearch nodes Process File Descriptors", "integer", []metricDef{
+		{key: "process_open_file_descriptors", label: "open"},
+		{key: "process_max_file_descriptors", label: "max"},
+	}},
+	{"ProcessFileDescriptorsUsedPercent", "Elasticsearch nodes Process File Descriptors Used Percent", "percentage", []metricDef{
+		{key: "process_file_descriptors_used_percent"},
+	}},
+	{"JvmUptime", "Elasticsearch nodes JVM Uptime (seconds)", "integer", []metricDef{
+		{key: "jvm_uptime_in_seconds"},
+	}},
+	{"JvmMemHeapUsedInBytes", "Elasticsearch nodes JVM Heap Mem", "bytes", []metricDef{
+		{key: "jvm_mem_heap_used_in_bytes", label: "used"},
+		{key: "jvm_mem_heap_max_in_bytes", label: "max"},
+		{key: "jvm_mem_heap_committed_in_bytes", label: "committed"},
+	}},
+	{"JvmNonHeap", "Elasticsearch nodes JVM Non-Heap Mem", "bytes", []metricDef{
+		{key: "jvm_mem_non_heap_used_in_bytes", label: "used"},
+		{key: "jvm_mem_non_heap_committed_in_bytes", label: "committed"},
+	}},
+	{"JvmMemHeapUsedPercent", "Elasticsearch nodes JVM Heap Mem Used Percent", "percentage", []metricDef{
+		{key: "jvm_mem_heap_used_percent"},
+	}},
+	{"JvmMemPoolYoung", "Elasticsearch nodes JVM Young Pool", "bytes", []metricDef{
+		{key: "jvm_mem_pools_young_used_in_bytes", label: "used"},
+		{key: "jvm_mem_pools_young_max_in_bytes", label: "max"},
+		{key: "jvm_mem_pools_young_peak_used_in_bytes", label: "peak"},
+	}},
+	{"JvmMemPoolSurvivor", "Elasticsearch nodes JVM Survivor Pool", "bytes", []metricDef{
+		{key: "jvm_mem_pools_survivor_used_in_bytes", label: "used"},
+		{key: "jvm_mem_pools_survivor_max_in_bytes", label: "max"},
+		{key: "jvm_mem_pools_survivor_peak_used_in_bytes", label: "peak"},
+	}},
+	{"JvmMemPoolOld", "Elasticsearch nodes JVM Old Pool", "bytes", []metricDef{
+		{key: "jvm_mem_pools_old_used_in_bytes", label: "used"},
+		{key: "jvm_mem_pools_old_max_in_bytes", label: "max"},
+		{key: "jvm_mem_pools_old_peak_used_in_bytes", label: "peak"},
+	}},
+	{"JvmGcOverhead", "Elasticsearch nodes JVM GC Overhead", "percentage", []metricDef{
+		{key: "jvm_gc_overhead_percent"},
+	}},
+	{"JvmThreads", "Elasticsearch nodes JVM Threads", "integer", []metricDef{
+		{key: "jvm_threads_count", label: "count"},
+		{key: "jvm_threads_peak_count", label: "peak"},
+	}},
+	{"JvmGcYoungCount", "Elasticsearch nodes JVM GC Young Collection Count", "integer", []metricDef{
+		{key: "jvm_gc_collectors_young_collection_count", diff: true},
+	}},
+	{"JvmGcYoungTime", "Elasticsearch nodes JVM GC Young Collection Time (ms)", "integer", []metricDef{
+		{key: "jvm_gc_collectors_young_collection_time_in_millis", diff: true},
+	}},
+	{"JvmGcOldCount", "Elasticsearch nodes JVM GC Old Collection Count", "integer", []metricDef{
+		{key: "jvm_gc_collectors_old_collection_count", diff: true},
+	}},
+	{"JvmGcOldTime", "Elasticsearch nodes JVM GC Old Collection Time (ms)", "integer", []metricDef{
+		{key: "jvm_gc_collectors_old_collection_time_in_millis", diff: true},
+	}},
+	{"JvmBufferPoolDirect", "Elasticsearch nodes JVM Direct Buffer Pool", "bytes", []metricDef{
+		{key: "jvm_buffer_pools_direct_used_in_bytes", label: "used"},
+		{key: "jvm_buffer_pools_direct_total_capacity_in_bytes", label: "capacity"},
+	}},
+	{"JvmBufferPoolMapped", "Elasticsearch nodes JVM Mapped Buffer Pool", "bytes", []metricDef{
+		{key: "jvm_buffer_pools_mapped_used_in_bytes", label: "used"},
+		{key: "jvm_buffer_pools_mapped_total_capacity_in_bytes", label: "capacity"},
+	}},
+	{"JvmBufferPoolCount", "Elasticsearch nodes JVM Buffer Pool Buffers", "integer", []metricDef{
+		{key: "jvm_buffer_pools_direct_count", label: "direct"},
+		{key: "jvm_buffer_pools_mapped_count", label: "mapped"},
+	}},
+	{"JvmClasses", "Elasticsearch nodes JVM Classes", "integer", []metricDef{
+		{key: "jvm_classes_current_loaded_count", label: "loaded"},
+		{key: "jvm_classes_total_loaded_count", label: "newly loaded", diff: true},
+		{key: "jvm_classes_total_unloaded_count", label: "unloaded", diff: true},
+	}},
+	{"DiskUsedInBytes", "Elasticsearch nodes Disk Used", "bytes", []metricDef{
+		{key: "disk_used_in_bytes"},
+	}},
+	{"DiskFree", "Elasticsearch nodes Disk Free", "bytes", []metricDef{
+		{key: "disk_free_in_bytes", label: "free"},
+		{key: "disk_available_in_bytes", label: "available"},
+	}},
+	{"DiskUsedPercent", "Elasticsearch nodes Disk Used Percent", "percentage", []metricDef{
+		{key: "disk_used_percent"},
+	}},
+	{"DataPathDiskUsedInBytes", "Elasticsearch nodes Data Path Disk Used", "bytes", []metricDef{
+		{key: "fs_data_*_disk_used_in_bytes"},
+	}},
+	{"DataPathDisk", "Elasticsearch nodes Data Path Disk", "bytes", []metricDef{
+		{key: "fs_data_*_total_in_bytes", label: "total"},
+		{key: "fs_data_*_free_in_bytes", label: "free"},
+		{key: "fs_data_*_available_in_bytes", label: "available"},
+	}},
+	{"DataPathDiskUsedPercent", "Elasticsearch nodes Data Path Disk Used Percent", "percentage", []metricDef{
+		{key: "fs_data_*_disk_used_percent"},
+	}},
+	{"FsIoStatsOperations", "Elasticsearch nodes Disk I/O Operations", "integer", []metricDef{
+		{key: "fs_io_stats_total_read_operations", label: "read", diff: true},
+		{key: "fs_io_stats_total_write_operations", label: "write", diff: true},
+		{key: "fs_io_stats_total_operations", label: "total", diff: true},
+	}},
+	{"FsIoStatsKilobytes", "Elasticsearch nodes Disk I/O (KB)", "integer", []metricDef{
+		{key: "fs_io_stats_total_read_kilobytes", label: "read", diff: true},
+		{key: "fs_io_stats_total_write_kilobytes", label: "write", diff: true},
+	}},
+	{"Docs", "Elasticsearch nodes Docs", "integer", []metricDef{
+		{key: "indices_docs_count", label: "count"},
+		{key: "indices_docs_deleted", label: "deleted"},
+	}},
+	{"IndicesStore", "Elasticsearch nodes Store", "bytes", []metricDef{
+		{key: "indices_store_size_in_bytes", label: "size"},
+		{key: "indices_store_reserved_in_bytes", label: "reserved"},
+	}},
+	{"IndicesIndexing", "Elasticsearch nodes Indexing", "integer", []metricDef{
+		{key: "indices_indexing_index_total", label: "indexed", diff: true},
+		{key: "indices_indexing_delete_total", label: "deleted", diff: true},
+		{key: "indices_indexing_noop_update_total", label: "noop updates", diff: true},
+	}},
+	{"IndicesIndexingTime", "Elasticsearch nodes Indexing Time (ms)", "integer", []metricDef{
+		{key: "indices_indexing_index_time_in_millis", label: "index", diff: true},
+		{key: "indices_indexing_delete_time_in_millis", label: "delete", diff: true},
+	}},
+	{"IndicesIndexingCurrent", "Elasticsearch nodes Indexing Current", "integer", []metricDef{
+		{key: "indices_indexing_index_current", label: "index"},
+		{key: "indices_indexing_delete_current", label: "delete"},
+	}},
+	{"IndicesIndexingFailed", "Elasticsearch nodes Indexing Failed", "integer", []metricDef{
+		{key: "indices_indexing_index_failed", diff: true},
+	}},
+	{"IndicesIndexingThrottleTime", "Elasticsearch nodes Indexing Throttle Time (ms)", "integer", []metricDef{
+		{key: "indices_indexing_throttle_time_in_millis", diff: true},
+	}},
+	{"IndicesSearch", "Elasticsearch nodes Search", "integer", []metricDef{
+		{key: "indices_search_query_total", label: "query", diff: true},
+		{key: "indices_search_fetch_total", label: "fetch", diff: true},
+		{key: "indices_search_suggest_total", label: "suggest", diff: true},
+	}},
+	{"IndicesSearchTime", "Elasticsearch nodes Search Time (ms)", "integer", []metricDef{
+		{key: "indices_search_query_time_in_millis", label: "query", diff: true},
+		{key: "indices_search_fetch_time_in_millis", label: "fetch", diff: true},
+		{key: "indices_search_suggest_time_in_millis", label: "suggest", diff: true},
+	}},
+	{"IndicesSearchCurrent", "Elasticsearch nodes Search Current", "integer", []metricDef{
+		{key: "indices_search_query_current", label: "query"},
+		{key: "indices_search_fetch_current", label: "fetch"},
+		{key: "indices_search_suggest_current", label: "suggest"},
+	}},
+	{"IndicesLatency", "Elasticsearch nodes Latency (ms)", "float", []metricDef{
+		{key: "indices_search_query_latency_in_millis", label: "query"},
+		{key: "indices_indexing_index_latency_in_millis", label: "index"},
+	}},
+	{"IndicesSearchOpenContexts", "Elasticsearch nodes Search Open Contexts", "integer", []metricDef{
+		{key: "indices_search_open_contexts"},
+	}},
+	{"IndicesSearchScroll", "Elasticsearch nodes Scroll", "integer", []metricDef{
+		{key: "indices_search_scroll_total", diff: true},
+	}},
+	{"IndicesSearchScrollTime", "Elasticsearch nodes Scroll Time (ms)", "integer", []metricDef{
+		{key: "indices_search_scroll_time_in_millis", diff: true},
+	}},
+	{"IndicesGet", "Elasticsearch nodes Get", "integer", []metricDef{
+		{key: "indices_get_total", label: "total", diff: true},
+		{key: "indices_get_exists_total", label: "exists", diff: true},
+		{key: "indices_get_missing_total", label: "missing", diff: true},
+	}},
+	{"IndicesGetTime", "Elasticsearch nodes Get Time (ms)", "integer", []metricDef{
+		{key: "indices_get_time_in_millis", diff: true},
+	}},
+	{"IndicesGetCurrent", "Elasticsearch nodes Get Current", "integer", []metricDef{
+		{key: "indices_get_current"},
+	}},
+	{"IndicesMergesCurrent", "Elasticsearch nodes Merges Current", "integer", []metricDef{
+		{key: "indices_merges_current", label: "merges"},
+		{key: "indices_merges_current_docs", label: "docs"},
+	}},
+	{"IndicesMergesCurrentSize", "Elasticsearch nodes Merges Current Size", "bytes", []metricDef{
+		{key: "indices_merges_current_size_in_bytes"},
+	}},
+	{"IndicesMerges", "Elasticsearch nodes Merges", "integer", []metricDef{
+		{key: "indices_merges_total", label: "merges", diff: true},
+		{key: "indices_merges_total_docs", label: "docs", diff: true},
+	}},
+	{"IndicesMergesSize", "Elasticsearch nodes Merged Size", "bytes", []metricDef{
+		{key: "indices_merges_total_size_in_bytes", diff: true},
+	}},
+	{"IndicesMergesThroughput", "Elasticsearch nodes Merges Throughput", "bytes/sec", []metricDef{
+		{key: "indices_merges_throughput_bytes_per_sec"},
+	}},
+	{"IndicesMergesTime", "Elasticsearch nodes Merges Time (ms)", "integer", []metricDef{
+		{key: "indices_merges_total_time_in_millis", diff: true},
+	}},
+	{"IndicesMergesThrottledTime", "Elasticsearch nodes Merges Throttled Time (ms)", "integer", []metricDef{
+		{key: "indices_merges_total_throttled_time_in_millis", diff: true},
+	}},
+	{"IndicesMergesAutoThrottle", "Elasticsearch nodes Merges Auto Throttle", "bytes", []metricDef{
+		{key: "indices_merges_total_auto_throttle_in_bytes"},
+	}},
+	{"IndicesRefresh", "Elasticsearch nodes Refresh", "integer", []metricDef{
+		{key: "indices_refresh_total", label: "total", diff: true},
+		{key: "indices_refresh_external_total", label: "external", diff: true},
+	}},
+	{"IndicesRefreshTime", "Elasticsearch nodes Refresh Time (ms)", "integer", []metricDef{
+		{key: "indices_refresh_total_time_in_millis", label: "total", diff: true},
+		{key: "indices_refresh_external_total_time_in_millis", label: "external", diff: true},
+	}},
+	{"IndicesRefreshListeners", "Elasticsearch nodes Refresh Listeners", "integer", []metricDef{
+		{key: "indices_refresh_listeners"},
+	}},
+	{"IndicesWarmer", "Elasticsearch nodes Warmer", "integer", []metricDef{
+		{key: "indices_warmer_total", label: "total", diff: true},
+		{key: "indices_warmer_current", label: "current"},
+	}},
+	{"IndicesWarmerTime", "Elasticsearch nodes Warmer Time (ms)", "integer", []metricDef{
+		{key: "indices_warmer_total_time_in_millis", diff: true},
+	}},
+	{"IndicesQueryCacheMemory", "Elasticsearch nodes Query Cache Memory", "bytes", []metricDef{
+		{key: "indices_query_cache_memory_size_in_bytes"},
+	}},
+	{"IndicesQueryCacheEntries", "Elasticsearch nodes Query Cache Entries", "integer", []metricDef{
+		{key: "indices_query_cache_cache_size", label: "size"},
+		{key: "indices_query_cache_cache_count", label: "count"},
+	}},
+	{"IndicesQueryCache", "Elasticsearch nodes Query Cache", "integer", []metricDef{
+		{key: "indices_query_cache_hit_count", label: "hit", diff: true},
+		{key: "indices_query_cache_miss_count", label: "miss", diff: true},
+		{key: "indices_query_cache_evictions", label: "evictions", diff: true},
+	}},
+	{"IndicesFielddataMemory", "Elasticsearch nodes Fielddata Memory", "bytes", []metricDef{
+		{key: "indices_fielddata_memory_size_in_bytes"},
+	}},
+	{"IndicesFielddataEvictions", "Elasticsearch nodes Fielddata Evictions", "integer", []metricDef{
+		{key: "indices_fielddata_evictions", diff: true},
+	}},
+	{"IndicesRequestCacheMemory", "Elasticsearch nodes Request Cache Memory", "bytes", []metricDef{
+		{key: "indices_request_cache_memory_size_in_bytes"},
+	}},
+	{"IndicesRequestCache", "Elasticsearch nodes Request Cache", "integer", []metricDef{
+		{key: "indices_request_cache_hit_count", label: "hit", diff: true},
+		{key: "indices_request_cache_miss_count", label: "miss", diff: true},
+		{key: "indices_request_cache_evictions", label: "evictions", diff: true},
+	}},
+	{"IndicesCompletion", "Elasticsearch nodes Completion Size", "bytes", []metricDef{
+		{key: "indices_completion_size_in_bytes"},
+	}},
+	{"IndicesTranslogOperations", "Elasticsearch nodes Translog Operations", "integer", []metricDef{
+		{key: "indices_translog_operations", label: "total"},
+		{key: "indices_translog_uncommitted_operations", label: "uncommitted"},
+	}},
+	{"IndicesTranslogSize", "Elasticsearch nodes Translog Size", "bytes", []metricDef{
+		{key: "indices_translog_size_in_bytes", label: "total"},
+		{key: "indices_translog_uncommitted_size_in_bytes", label: "uncommitted"},
+	}},
+	{"IndicesTranslogAge", "Elasticsearch nodes Translog Earliest Last Modified Age (ms)", "integer", []metricDef{
+		{key: "indices_translog_earliest_last_modified_age"},
+	}},
+	{"IndicesRecovery", "Elasticsearch nodes Recoveries", "integer", []metricDef{
+		{key: "indices_recovery_current_as_source", label: "as source"},
+		{key: "indices_recovery_current_as_target", label: "as target"},
+	}},
+	{"IndicesRecoveryThrottleTime", "Elasticsearch nodes Recovery Throttle Time (ms)", "integer", []metricDef{
+		{key: "indices_recovery_throttle_time_in_millis", diff: true},
+	}},
+	{"IndicesShards", "Elasticsearch nodes Shards", "integer", []metricDef{
+		{key: "indices_shard_stats_total_count"},
+	}},
+	{"IndicesMappingsFields", "Elasticsearch nodes Mapped Fields", "integer", []metricDef{
+		{key: "indices_mappings_total_count", label: "total"},
+		{key: "indices_mappings_total_deduplicated_field_count", label: "deduplicated"},
+	}},
+	{"IndicesMappingsSize", "Elasticsearch nodes Mappings Size", "bytes", []metricDef{
+		{key: "indices_mappings_total_estimated_overhead_in_bytes", label: "estimated overhead"},
+		{key: "indices_mappings_total_deduplicated_mapping_size_in_bytes", label: "deduplicated"},
+	}},
+	{"IndicesBulk", "Elasticsearch nodes Bulk Operations", "integer", []metricDef{
+		{key: "indices_bulk_total_operations", diff: true},
+	}},
+	{"IndicesBulkTime", "Elasticsearch nodes Bulk Time (ms)", "integer", []metricDef{
+		{key: "indices_bulk_total_time_in_millis", label: "total", diff: true},
+		{key: "indices_bulk_avg_time_in_millis", label: "average"},
+	}},
+	{"IndicesBulkSize", "Elasticsearch nodes Bulk Size", "bytes", []metricDef{
+		{key: "indices_bulk_total_size_in_bytes", label: "total", diff: true},
+		{key: "indices_bulk_avg_size_in_bytes", label: "average"},
+	}},
+	{"IndicesDenseVector", "Elasticsearch nodes Dense Vectors", "integer", []metricDef{
+		{key: "indices_dense_vector_value_count"},
+	}},
+	{"IndicesCacheHitPercent", "Elasticsearch nodes Cache Hit Percent", "percentage", []metricDef{
+		{key: "indices_query_cache_hit_percent", label: "query cache"},
+		{key: "indices_request_cache_hit_percent", label: "request cache"},
+	}},
+	{"IndexingBuffer", "Elasticsearch nodes Indexing Buffer", "bytes", []metricDef{
+		{key: "total_indexing_buffer_in_bytes", label: "total"},
+		{key: "indices_segments_index_writer_memory_in_bytes", label: "index writer"},
+	}},
+	{"IndicesFlush", "Elasticsearch nodes Flush", "integer", []metricDef{
+		{key: "indices_flush_total", label: "total", diff: true},
+		{key: "indices_flush_periodic_total", label: "periodic", diff: true},
+	}},
+	{"IndicesFlushTime", "Elasticsearch nodes Flush Time (ms)", "integer", []metricDef{
+		{key: "indices_flush_total_time_in_millis", diff: true},
+	}},
+	{"IndicesSegmentsCount", "Elasticsearch nodes Segments", "integer", []metricDef{
+		{key: "indices_segments_count"},
+	}},
+	{"IndicesSegmentsMemoryTotal", "Elasticsearch nodes Segments Memory Total", "bytes", []metricDef{
+		{key: "indices_segments_memory_in_bytes"},
+	}},
+	{"IndicesSegmentsMemory", "Elasticsearch nodes Segments Memory", "bytes", []metricDef{
+		{key: "indices_segments_terms_memory_in_bytes", label: "terms", stacked: true},
+		{key: "indices_segments_stored_fields_memory_in_bytes", label: "stored fields", stacked: true},
+		{key: "indices_segments_term_vectors_memory_in_bytes", label: "term vectors", stacked: true},
+		{key: "indices_segments_norms_memory_in_bytes", label: "norms", stacked: true},
+		{key: "indices_segments_points_memory_in_bytes", label: "points", stacked: true},
+		{key: "indices_segments_doc_values_memory_in_bytes", label: "doc values", stacked: true},
+		{key: "indices_segments_index_writer_memory_in_bytes", label: "index writer", stacked: true},
+		{key: "indices_segments_version_map_memory_in_bytes", label: "version map", stacked: true},
+		{key: "indices_segments_fixed_bit_set_memory_in_bytes", label: "fixed bitset", stacked: true},
+	}},
+	{"JvmOldPoolPeakReset", "Elasticsearch nodes JVM Old Pool Peak Reset", "integer", []metricDef{
+		{key: "jvm_old_pool_peak_reset"},
+	}},
+	{"ThreadPoolQueuePercent", "Elasticsearch nodes Thread Pool Queue Usage", "percentage", []metricDef{
+		{key: "threadpool_*_queue_percent"},
+	}},
+	{"ThreadPoolQueue", "Elasticsearch nodes Thread Pool Queue", "integer", []metricDef{
+		{key: "threadpool_*_queue"},
+	}},
+	{"ThreadPoolActive", "Elasticsearch nodes Thread Pool Active Threads", "integer", []metricDef{
+		{key: "threadpool_*_active"},
+	}},
+	{"ThreadPoolThreads", "Elasticsearch nodes Thread Pool Threads", "integer", []metricDef{
+		{key: "threadpool_*_threads"},
+	}},
+	{"ThreadPoolLargest", "Elasticsearch nodes Thread Pool Largest Threads", "integer", []metricDef{
+		{key: "threadpool_*_largest"},
+	}},
+	{"ThreadPoolCompleted", "Elasticsearch nodes Thread Pool Completed", "integer", []metricDef{
+		{key: "threadpool_*_completed", diff: true},
+	}},
+	{"ThreadPoolRejected", "Elasticsearch nodes Thread Pool Rejected", "integer", []metricDef{
+		{key: "threadpool_*_rejected", diff: true},
+	}},
+	{"Breakers", "Elasticsearch nodes Circuit Breakers", "bytes", []metricDef{
+		{key: "breakers_*_estimated_size_in_bytes", label: "estimated"},
+		{key: "breakers_*_limit_size_in_bytes", label: "limit"},
+	}},
+	{"BreakersTripped", "Elasticsearch nodes Circuit Breakers Tripped", "integer", []metricDef{
+		{key: "breakers_*_tripped", diff: true},
+	}},
+	{"TransportServerOpen", "Elasticsearch nodes Transport Open Connections", "integer", []metricDef{
+		{key: "transport_server_open"},
+	}},
+	{"TransportCount", "Elasticsearch nodes Transport Messages", "integer", []metricDef{
+		{key: "transport_rx_count", label: "rx", diff: true},
+		{key: "transport_tx_count", label: "tx", diff: true},
+	}},
+	{"TransportSize", "Elasticsearch nodes Transport Traffic", "bytes", []metricDef{
+		{key: "transport_rx_size_in_bytes", label: "rx", diff: true},
+		{key: "transport_tx_size_in_bytes", label: "tx", diff: true},
+	}},
+	{"TransportOutboundConnections", "Elasticsearch nodes Transport Outbound Connections Opened", "integer", []metricDef{
+		{key: "transport_total_outbound_connections", diff: true},
+	}},
+	{"TransportSlowHandling", "Elasticsearch nodes Transport Handling Over 1s", "integer", []metricDef{
+		{key: "transport_inbound_handling_time_slow_count", label: "inbound", diff: true},
+		{key: "transport_outbound_handling_time_slow_count", label: "outbound", diff: true},
+	}},
+	{"HTTPConnections", "Elasticsearch nodes HTTP Connections", "integer", []metricDef{
+		{key: "http_current_open", label: "open"},
+		{key: "http_total_opened", label: "opened", diff: true},
+	}},
+	{"HTTPClients", "Elasticsearch nodes HTTP Clients", "integer", []metricDef{
+		{key: "http_clients_count", label: "clients"},
+	}},
+	{"HTTPClientsRequests", "Elasticsearch nodes HTTP Client Requests", "integer", []metricDef{
+		{key: "http_clients_request_count", diff: true},
+	}},
+	{"Script", "Elasticsearch nodes Scripts", "integer", []metricDef{
+		{key: "script_compilations", label: "compilations", diff: true},
+		{key: "script_cache_evictions", label: "cache evictions", diff: true},
+		{key: "script_compilation_limit_triggered", label: "compilation limit triggered", diff: true},
+	}},
+	{"ScriptContextCompilations", "Elasticsearch nodes Script Compilations per Context", "integer", []metricDef{
+		{key: "script_context_*_compilations", diff: true},
+	}},
+	{"ScriptContextCacheEvictions", "Elasticsearch nodes Script Cache Evictions per Context", "integer", []metricDef{
+		{key: "script_context_*_cache_evictions", diff: true},
+	}},
+	{"ScriptContextCompilationLimitTriggered", "Elasticsearch nodes Script Compilation Limit Triggered per Context", "integer", []metricDef{
+		{key: "script_context_*_compilation_limit_triggered", diff: true},
+	}},
+	{"Ingest", "Elasticsearch nodes Ingest", "integer", []metricDef{
+		{key: "ingest_total_count", label: "count", diff: true},
+		{key: "ingest_total_failed", label: "failed", diff: true},
+	}},
+	{"IngestTime", "Elasticsearch nodes Ingest Time (ms)", "integer", []metricDef{
+		{key: "ingest_total_time_in_millis", diff: true},
+	}},
+	{"IngestCurrent", "Elasticsearch nodes Ingest Current", "integer", []metricDef{
+		{key: "ingest_total_current"},
+	}},
+	{"IngestPipeline", "Elasticsearch nodes Ingest Pipelines", "integer", []metricDef{
+		{key: "ingest_pipeline_*_count", diff: true},
+	}},
+	{"IngestPipelineFailed", "Elasticsearch nodes Ingest Pipelines Failed", "integer", []metricDef{
+		{key: "ingest_pipeline_*_failed", diff: true},
+	}},
+	{"IngestPipelineTime", "Elasticsearch nodes Ingest Pipelines Time (ms)", "integer", []metricDef{
+		{key: "ingest_pipeline_*_time_in_millis", diff: true},
+	}},
+	{"IngestPipelineCurrent", "Elasticsearch nodes Ingest Pipelines Current", "integer", []metricDef{
+		{key: "ingest_pipeline_*_current"},
+	}},
+	{"DiscoveryClusterStateQueue", "Elasticsearch nodes Cluster State Queue", "integer", []metricDef{
+		{key: "discovery_cluster_state_queue_total", label: "total"},
+		{key: "discovery_cluster_state_queue_pending", label: "pending"},
+		{key: "discovery_cluster_state_queue_committed", label: "committed"},
+	}},
+	{"DiscoveryClusterStateUpdate", "Elasticsearch nodes Cluster State Updates", "integer", []metricDef{
+		{key: "discovery_cluster_state_update_*_count", diff: true},
+	}},
+	{"DiscoveryClusterApplier", "Elasticsearch nodes Cluster State Applier", "integer", []metricDef{
+		{key: "discovery_cluster_applier_execution_count", label: "executions", diff: true},
+	}},
+	{"DiscoveryClusterApplierTime", "Elasticsearch nodes Cluster State Applier Time (ms)", "integer", []metricDef{
+		{key: "discovery_cluster_applier_execution_time_millis", diff: true},
+	}},
+	{"DiscoveryPublishedClusterStates", "Elasticsearch nodes Published Cluster States", "integer", []metricDef{
+		{key: "discovery_published_cluster_states_full_states", label: "full states", diff: true},
+		{key: "discovery_published_cluster_states_incompatible_diffs", label: "incompatible diffs", diff: true},
+		{key: "discovery_published_cluster_states_compatible_diffs", label: "compatible diffs", diff: true},
+	}},
+	{"DiscoverySerializedClusterStates", "Elasticsearch nodes Serialized Cluster States", "integer", []metricDef{
+		{key: "discovery_serialized_cluster_states_full_states_count", label: "full states", diff: true},
+		{key: "discovery_serialized_cluster_states_diffs_count", label: "diffs", diff: true},
+	}},
+	{"AdaptiveSelectionRank", "Elasticsearch nodes Adaptive Selection Max Rank", "float", []metricDef{
+		{key: "adaptive_selection_max_rank"},
+	}},
+	{"AdaptiveSelectionTime", "Elasticsearch nodes Adaptive Selection Max Time (ns)", "integer", []metricDef{
+		{key: "adaptive_selection_max_avg_response_time_ns", label: "response"},
+		{key: "adaptive_selection_max_avg_service_time_ns", label: "service"},
+	}},
+	{"AdaptiveSelectionQueueSize", "Elasticsearch nodes Adaptive Selection Max Queue Size", "float", []metricDef{
+		{key: "adaptive_selection_max_avg_queue_size"},
+	}},
+	{"AdaptiveSelectionNodeRank", "Elasticsearch nodes Adaptive Selection Rank", "float", []metricDef{
+		{key: "adaptive_selection_node_*_rank"},
+	}},
+	{"AdaptiveSelectionNodeResponseTime", "Elasticsearch nodes Adaptive Selection Response Time (ns)", "integer", []metricDef{
+		{key: "adaptive_selection_node_*_avg_response_time_ns"},
+	}},
+	{"AdaptiveSelectionNodeServiceTime", "Elasticsearch nodes Adaptive Selection Service Time (ns)", "integer", []metricDef{
+		{key: "adaptive_selection_node_*_avg_service_time_ns"},
+	}},
+	{"AdaptiveSelectionNodeQueueSize", "Elasticsearch nodes Adaptive Selection Queue Size", "float", []metricDef{
+		{key: "adaptive_selection_node_*_avg_queue_size"},
+	}},
+	{"IndexingPressureMemory", "Elasticsearch nodes Indexing Pressure Memory", "bytes", []metricDef{
+		{key: "indexing_pressure_current_bytes", label: "current"},
+		{key: "indexing_pressure_current_coordinating_bytes", label: "current coordinating"},
+		{key: "indexing_pressure_current_primary_bytes", label: "current primary"},
+		{key: "indexing_pressure_current_replica_bytes", label: "current replica"},
+		{key: "indexing_pressure_limit_bytes", label: "limit"},
+	}},
+	{"IndexingPressureTotal", "Elasticsearch nodes Indexing Pressure Bytes", "bytes", []metricDef{
+		{key: "indexing_pressure_total_bytes", label: "combined", diff: true},
+		{key: "indexing_pressure_total_coordinating_bytes", label: "coordinating", diff: true},
+		{key: "indexing_pressure_total_primary_bytes", label: "primary", diff: true},
+		{key: "indexing_pressure_total_replica_bytes", label: "replica", diff: true},
+	}},
+	{"IndexingPressureRejections", "Elasticsearch nodes Indexing Pressure Rejections", "integer", []metricDef{
+		{key: "indexing_pressure_rejections", label: "total", diff: true},
+		{key: "indexing_pressure_coordinating_rejections", label: "coordinating", diff: true},
+		{key: "indexing_pressure_primary_rejections", label: "primary", diff: true},
+		{key: "indexing_pressure_replica_rejections", label: "replica", diff: true},
+	}},
+	{"NodeVersionInfo", "Elasticsearch nodes Version", "integer", []metricDef{
+		{key: "node_version_info_*"},
+	}},
+}
+
+// clusterGraphDefs are looked up in ClusterStats rather than per node.
+var clusterGraphDefs = []graphDef{
+	{"TierJvmMemHeapUsedInBytes", "Elasticsearch tiers JVM Heap Mem Used", "bytes", []metricDef{
+		{key: "tier_*_jvm_mem_heap_used_in_bytes"},
+	}},
+	{"TierDiskUsedInBytes", "Elasticsearch tiers Disk Used", "bytes", []metricDef{
+		{key: "tier_*_disk_used_in_bytes"},
+	}},
+	{"ClusterCapacity", "Elasticsearch cluster Capacity", "bytes", []metricDef{
+		{key: "cluster_capacity_disk_total_in_bytes", label: "disk total"},
+		{key: "cluster_capacity_disk_used_in_bytes", label: "disk used"},
+		{key: "cluster_capacity_jvm_mem_heap_max_in_bytes", label: "heap max"},
+		{key: "cluster_capacity_jvm_mem_heap_used_in_bytes", label: "heap used"},
+	}},
+	{"ClusterNodes", "Elasticsearch nodes Responding", "integer", []metricDef{
+		{key: "cluster_nodes_total", label: "total"},
+		{key: "cluster_nodes_successful", label: "successful"},
+		{key: "cluster_nodes_failed", label: "failed"},
+	}},
+	{"PluginSelf", "Elasticsearch nodes Plugin", "float", []metricDef{
+		{key: "plugin_metrics_truncated", label: "metrics truncated"},
+		{key: "plugin_connect_ms", label: "connect ms"},
+		{key: "plugin_ttfb_ms", label: "time to first byte ms"},
+	}},
+}
+
+// series returns the metrics m yields from stats, skipping metrics that were
+// not reported. Names are prefixed with prefix and labels start with label.
+// names overrides what the "*" stands for in labels, keyed by metric key.
+func (m metricDef) series(prefix, label string, stats map[string]float64, names map[string]string) [](mp.Metrics) {
+	if !strings.Contains(m.key, "*") {
+		if _, ok := stats[m.key]; !ok {
+			return nil
+		}
+		return [](mp.Metrics){
+			{Name: prefix + m.key, Label: joinLabel(label, m.label), Diff: m.diff, Stacked: m.stacked, Type: "float64"},
+		}
+	}
+
+	metrics := [](mp.Metrics){}
+	for _, key := range sortedKeys(stats) {
+		name, ok := m.match(key)
+		if !ok {
+			continue
+		}
+		if original, ok := names[key]; ok {
+			name = original
+		}
+		metrics = append(metrics,
+			mp.Metrics{Name: prefix + key, Label: joinLabel(label, m.label, name), Diff: m.diff, Stacked: m.stacked, Type: "float64"})
+	}
+
+	return metrics
+}
+
+// match reports whether key is one of m's keys, returning what the "*"
+// stands for, if any.
+func (m metricDef) match(key string) (name string, ok bool) {
+	i := strings.Index(m.key, "*")
+	if i < 0 {
+		return "", key == m.key
+	}
+
+	keyPrefix, keySuffix := m.key[:i], m.key[i+1:]
+	if len(key) <= len(keyPrefix)+len(keySuffix) || !strings.HasPrefix(key, keyPrefix) || !strings.HasSuffix(key, keySuffix) {
+		return "", false
+	}
+
+	return key[len(keyPrefix) : len(key)-len(keySuffix)], true
+}
+
+func joinLabel(parts ...string) string {
+	label := ""
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+		if label != "" {
+			label += " "
+		}
+		label += part
+	}
+
+	return label
+}
+
 // GraphDefinition interface for mackerelplugin
 func (p ElasticsearchNodesPlugin) GraphDefinition() map[string](mp.Graphs) {
 	graphdef := make(map[string](mp.Graphs))
 
-	metricsOsLoadAverage := [](mp.Metrics){}
-	metricsProcessCpuPercent := [](mp.Metrics){}
-	metricsJvmMemHeapUsedInBytes := [](mp.Metrics){}
-	metricsDiskUsedInBytes := [](mp.Metrics){}
+	for _, g := range graphDefs {
+		metrics := make(map[string][](mp.Metrics))
+		for _, nodeName := range p.nodeNames() {
+			group := p.RoleGroups[nodeName]
+			for _, m := range g.metrics {
+				metrics[group] = append(metrics[group], m.series(nodeName+"_", nodeName, p.Stats[nodeName], p.Labels[nodeName])...)
+			}
+		}
+		for group, groupMetrics := range metrics {
+			addGraph(graphdef, group, g, groupMetrics)
+		}
+	}
+
+	for _, g := range clusterGraphDefs {
+		metrics := [](mp.Metrics){}
+		for _, m := range g.metrics {
+			metrics = append(metrics, m.series("", "", p.ClusterStats, nil)...)
+		}
+		addGraph(graphdef, "", g, metrics)
+	}
+
+	return graphdef
+}
+
+// addGraph adds g with metrics to graphdef. Graphs of a role group go to
+// their own elasticsearch-nodes-<group> namespace.
+func addGraph(graphdef map[string](mp.Graphs), group string, g graphDef, metrics [](mp.Metrics)) {
+	if len(metrics) == 0 {
+		return
+	}
+
+	namespace, label := "elasticsearch-nodes", g.label
+	if group != "" {
+		namespace += "-" + group
+		label += " (" + group + ")"
+	}
+	graphdef[namespace+"."+g.name] = mp.Graphs{
+		Label:   label,
+		Unit:    g.unit,
+		Metrics: metrics,
+	}
+}
 
-	for nodeName, _ := range p.Stats {
-		metricsOsLoadAverage = append(metricsOsLoadAverage,
-			mp.Metrics{Name: nodeName + "_os_load_average", Label: nodeName, Diff: false, Type: "uint64"})
-		metricsProcessCpuPercent = append(metricsProcessCpuPercent,
-			mp.Metrics{Name: nodeName + "_process_cpu_percent", Label: nodeName, Diff: false, Type: "uint64"})
-		metricsJvmMemHeapUsedInBytes = append(metricsJvmMemHeapUsedInBytes,
-			mp.Metrics{Name: nodeName + "_jvm_mem_heap_used_in_bytes", Label: nodeName, Diff: false, Type: "uint64"})
-		metricsDiskUsedInBytes = append(metricsDiskUsedInBytes,
-			mp.Metrics{Name: nodeName + "_disk_used_in_bytes", Label: nodeName, Diff: false, Type: "uint64"})
+func (p ElasticsearchNodesPlugin) nodeNames() []string {
+	nodeNames := make([]string, 0, len(p.Stats))
+	for nodeName := range p.Stats {
+		nodeNames = append(nodeNames, nodeName)
 	}
+	sort.Strings(nodeNames)
+
+	return nodeNames
+}
 
-	graphdef["elasticsearch-nodes.OSLoadAverage"] = mp.Graphs{
-		Label:   "Elasticsearch nodes OS Load Average",
-		Unit:    "float",
-		Metrics: metricsOsLoadAverage,
+// outputJSONLines writes each node's metrics as one JSON object per line.
+func (p ElasticsearchNodesPlugin) outputJSONLines(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, nodeName := range p.nodeNames() {
+		line := map[string]interface{}{"node": nodeName}
+		for metricKey, metricValue := range p.Stats[nodeName] {
+			line[metricKey] = metricValue
+		}
+		err := enc.Encode(line)
+		if err != nil {
+			return err
+		}
 	}
 
-	graphdef["elasticsearch-nodes.ProcessCPUPercent"] = mp.Graphs{
-		Label:   "Elasticsearch nodes Process CPU Percent",
-		Unit:    "percentage",
-		Metrics: metricsProcessCpuPercent,
+	return nil
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
 
-	graphdef["elasticsearch-nodes.JvmMemHeapUsedInBytes"] = mp.Graphs{
-		Label:   "Elasticsearch nodes JVM Heap Mem Used",
-		Unit:    "bytes",
-		Metrics: metricsJvmMemHeapUsedInBytes,
+	return keys
+}
+
+var unsafeMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// sanitizeMetricName turns s (e.g. a data path) into a metric key component.
+func sanitizeMetricName(s string) string {
+	return strings.Trim(unsafeMetricChars.ReplaceAllString(s, "_"), "_")
+}
+
+// majorVersion returns the major version of an Elasticsearch version such as
+// 8.11.1, or 0 if it cannot tell.
+func majorVersion(version string) int {
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err != nil {
+		return 0
 	}
 
-	graphdef["elasticsearch-nodes.DiskUsedInBytes"] = mp.Graphs{
-		Label:   "Elasticsearch nodes Disk Used",
-		Unit:    "bytes",
-		Metrics: metricsDiskUsedInBytes,
+	return major
+}
+
+// parseQueueSizes parses a comma separated list of pool=size pairs.
+func parseQueueSizes(s string) (map[string]float64, error) {
+	sizes := make(map[string]float64)
+	if s == "" {
+		return sizes, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid queue size %q, expected pool=size", pair)
+		}
+		size, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid queue size %q: %s", pair, err)
+		}
+		sizes[kv[0]] = size
 	}
 
-	return graphdef
+	return sizes, nil
+}
+
+// parseSet parses a comma separated list, returning nil for an empty one.
+func parseSet(s string) map[string]bool {
+	if s == "" {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, item := range strings.Split(s, ",") {
+		set[item] = true
+	}
+
+	return set
+}
+
+// parsePipelines parses a comma separated list of pipeline IDs or regular
+// expressions, each of which has to match a whole ID. It returns nil for an
+// empty list.
+func parsePipelines(s string) (*regexp.Regexp, error) {
+	if s == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile("^(?:" + strings.Replace(s, ",", "|", -1) + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid ingest pipelines %q: %s", s, err)
+	}
+
+	return re, nil
+}
+
+// discardStaleTempfile removes tempfile when it is older than maxAge. The
+// helper then has no previous values, skips Diff metrics for this run and
+// only records a new baseline.
+func discardStaleTempfile(tempfile string, maxAge time.Duration) {
+	fi, err := os.Stat(tempfile)
+	if err != nil {
+		return
+	}
+	if time.Since(fi.ModTime()) > maxAge {
+		os.Remove(tempfile)
+	}
 }
 
 func main() {
@@ -159,17 +2463,103 @@ func main() {
 	optHost := flag.String("host", "localhost", "Host")
 	optPort := flag.String("port", "9200", "Port")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optSSH := flag.String("ssh", "", "Reach the host through an SSH tunnel via this bastion (user@bastion)")
+	optSSHKey := flag.String("ssh-key", "", "Private key file for -ssh")
+	optExpectCluster := flag.String("expect-cluster", "", "Fail unless the cluster has this name")
+	optNodeAttr := flag.String("node-attr", "", "Only collect the single node with this attribute (key=value)")
+	optThreadPoolQueueSizes := flag.String("thread-pool-queue-sizes", "", "Queue sizes per thread pool (e.g. write=10000,search=1000), overriding node info")
+	optThreadPools := flag.String("thread-pools", "bulk,write,index,search,get,management,snapshot", "Thread pools to emit (empty for all of them)")
+	optScriptContexts := flag.String("script-contexts", "", "Script contexts to emit script cache stats for (e.g. ingest,update,search)")
+	optIngestPipelines := flag.String("ingest-pipelines", "", "Ingest pipelines to emit stats for, as a comma separated list of IDs or regular expressions")
+	optDeltaNodes := flag.Bool("delta-nodes", false, "Experimental: emit only nodes whose metrics changed since their last emission")
+	optDeltaThreshold := flag.Float64("delta-threshold", 1, "Percent change that counts as changed in -delta-nodes mode")
+	optStatePruneRuns := flag.Uint64("state-prune-runs", 10, "Forget nodes missing from the state file for this many runs (0 keeps them forever)")
+	optGroupByTier := flag.Bool("group-by-tier", false, "Also emit metrics summed per data tier")
+	optPrefixByRole := flag.Bool("prefix-by-role", false, "Put each node's graphs under elasticsearch-nodes-<role> by its primary role")
+	optRolePriority := flag.String("role-priority", "data_hot,data_warm,data_cold,data_frozen,data_content,data,master,ingest", "Roles in order of preference when picking a node's primary role")
+	optMaxMetrics := flag.Int("max-metrics", 0, "Emit at most this many metrics, in lexical order of their names (0 means no limit)")
+	optFormat := flag.String("format", "mackerel", "Output format: mackerel or jsonl")
+	optDataPaths := flag.Bool("data-paths", true, "Emit disk metrics per data path")
+	optHTTPClients := flag.Bool("http-clients", false, "Emit the number of tracked HTTP clients and their requests (Elasticsearch 7.13+)")
+	optSegmentsMemory := flag.Bool("segments-memory", false, "Emit the memory used by each part of the segments")
+	optAdaptiveSelection := flag.Bool("adaptive-selection", false, "Emit the worst adaptive replica selection stats each node sees among the nodes it searches")
+	optAdaptiveSelectionMatrix := flag.Bool("adaptive-selection-matrix", false, "Emit adaptive replica selection stats for every pair of nodes")
+	optMaxTempfileAge := flag.Duration("max-tempfile-age", 0, "Discard a tempfile older than this so Diff metrics restart from a fresh baseline (0 disables)")
 	flag.Parse()
 
+	if *optFormat != "mackerel" && *optFormat != "jsonl" {
+		log.Fatalln(fmt.Sprintf("invalid format %q, expected mackerel or jsonl", *optFormat))
+	}
+
+	queueSizes, err := parseQueueSizes(*optThreadPoolQueueSizes)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ingestPipelines, err := parsePipelines(*optIngestPipelines)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	tempfile := *optTempfile
+	if tempfile == "" {
+		tempfile = fmt.Sprintf("/tmp/mackerel-plugin-elasticsearch-nodes-stats-%s-%s", *optHost, *optPort)
+	}
+	// JSON Lines output is for runs by hand, which must not disturb the
+	// agent's tempfile or state.
+	jsonl := *optFormat == "jsonl"
+	if *optMaxTempfileAge > 0 && !jsonl {
+		discardStaleTempfile(tempfile, *optMaxTempfileAge)
+	}
+
 	var elasticsearchNodes ElasticsearchNodesPlugin
 	elasticsearchNodes.URI = fmt.Sprintf("%s://%s:%s", *optScheme, *optHost, *optPort)
-	elasticsearchNodes.loadStats()
+	elasticsearchNodes.StateFile = tempfile + ".state"
+	elasticsearchNodes.StateReadOnly = jsonl
+	elasticsearchNodes.ExpectCluster = *optExpectCluster
+	elasticsearchNodes.NodeAttr = *optNodeAttr
+	elasticsearchNodes.ThreadPoolQueueSizes = queueSizes
+	elasticsearchNodes.ThreadPools = parseSet(*optThreadPools)
+	elasticsearchNodes.ScriptContexts = parseSet(*optScriptContexts)
+	elasticsearchNodes.IngestPipelines = ingestPipelines
+	elasticsearchNodes.DeltaNodes = *optDeltaNodes
+	elasticsearchNodes.DeltaThreshold = *optDeltaThreshold
+	elasticsearchNodes.StatePruneRuns = *optStatePruneRuns
+	elasticsearchNodes.GroupByTier = *optGroupByTier
+	elasticsearchNodes.MaxMetrics = *optMaxMetrics
+	elasticsearchNodes.PrefixByRole = *optPrefixByRole
+	elasticsearchNodes.RolePriority = strings.Split(*optRolePriority, ",")
+	elasticsearchNodes.DataPaths = *optDataPaths
+	elasticsearchNodes.HTTPClients = *optHTTPClients
+	elasticsearchNodes.SegmentsMemory = *optSegmentsMemory
+	elasticsearchNodes.AdaptiveSelection = *optAdaptiveSelection
+	elasticsearchNodes.AdaptiveSelectionMatrix = *optAdaptiveSelectionMatrix
 
-	helper := mp.NewMackerelPlugin(elasticsearchNodes)
-	if *optTempfile != "" {
-		helper.Tempfile = *optTempfile
-	} else {
-		helper.Tempfile = fmt.Sprintf("/tmp/mackerel-plugin-elasticsearch-nodes-stats-%s-%s", *optHost, *optPort)
+	var tunnel *sshTunnel
+	if *optSSH != "" {
+		tunnel, err = openSSHTunnel(*optSSH, *optSSHKey, *optHost, *optPort)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		elasticsearchNodes.URI = fmt.Sprintf("%s://%s", *optScheme, tunnel.localAddr)
+	}
+	err = elasticsearchNodes.loadStats()
+	if tunnel != nil {
+		tunnel.Close()
 	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if jsonl {
+		err := elasticsearchNodes.outputJSONLines(os.Stdout)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	helper := mp.NewMackerelPlugin(elasticsearchNodes)
+	helper.Tempfile = tempfile
 	helper.Run()
 }
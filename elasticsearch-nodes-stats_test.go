@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestPlugin returns a plugin talking to a server that answers node stats
+// with whatever nodesStats points to and node info with no nodes.
+func newTestPlugin(t *testing.T, nodesStats *string) (*ElasticsearchNodesPlugin, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_nodes/stats" {
+			io.WriteString(w, *nodesStats)
+			return
+		}
+		io.WriteString(w, `{"nodes":{}}`)
+	}))
+	dir, err := ioutil.TempDir("", "elasticsearch-nodes-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &ElasticsearchNodesPlugin{
+		URI:       server.URL,
+		StateFile: filepath.Join(dir, "state"),
+	}
+
+	return p, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLoadStatsStatePruneRunsZero(t *testing.T) {
+	nodesStats := `{"nodes":{"n1":{"name":"gone"}}}`
+	p, done := newTestPlugin(t, &nodesStats)
+	defer done()
+
+	err := p.loadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodesStats = `{"nodes":{"n2":{"name":"stays"}}}`
+	for i := 0; i < 20; i++ {
+		err = p.loadStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state, err := loadState(p.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Nodes["gone"]; !ok {
+		t.Error("node was pruned although -state-prune-runs is 0")
+	}
+}
+
+func TestOsAddStatsPartialLoadAverage(t *testing.T) {
+	var nodeOs ElasticsearchNodeOs
+	err := json.Unmarshal([]byte(`{"cpu":{"percent":3,"load_average":{"1m":1.5}}}`), &nodeOs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodeStats := make(map[string]float64)
+	nodeOs.addStats(nodeStats)
+
+	if got := nodeStats["os_load_average_1m"]; got != 1.5 {
+		t.Errorf("os_load_average_1m = %v, want 1.5", got)
+	}
+	for _, key := range []string{"os_load_average_5m", "os_load_average_15m"} {
+		if _, ok := nodeStats[key]; ok {
+			t.Errorf("%s emitted although the node does not report it", key)
+		}
+	}
+}
+
+func TestOsAddStatsMemUsedPercent(t *testing.T) {
+	cases := []struct {
+		name string
+		os   string
+		want float64
+	}{
+		{"adjusted total", `{"mem":{"total_in_bytes":1000,"adjusted_total_in_bytes":500,"free_in_bytes":250,"used_in_bytes":750,"used_percent":75}}`, 50},
+		{"host used beyond adjusted total", `{"mem":{"total_in_bytes":64,"adjusted_total_in_bytes":8,"free_in_bytes":4,"used_in_bytes":60,"used_percent":94}}`, 50},
+		{"host free beyond adjusted total", `{"mem":{"total_in_bytes":64,"adjusted_total_in_bytes":8,"free_in_bytes":40,"used_in_bytes":24,"used_percent":38}}`, 0},
+		{"cgroup usage", `{"mem":{"total_in_bytes":64,"adjusted_total_in_bytes":8,"free_in_bytes":4,"used_in_bytes":60,"used_percent":94},"cgroup":{"memory":{"usage_in_bytes":"2"}}}`, 25},
+		{"total", `{"mem":{"total_in_bytes":1000,"used_in_bytes":250,"used_percent":99}}`, 25},
+		{"used percent", `{"mem":{"total_in_bytes":0,"adjusted_total_in_bytes":0,"used_in_bytes":0,"used_percent":40}}`, 40},
+	}
+	for _, c := range cases {
+		var nodeOs ElasticsearchNodeOs
+		err := json.Unmarshal([]byte(c.os), &nodeOs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		nodeStats := make(map[string]float64)
+		nodeOs.addStats(nodeStats)
+
+		if got := nodeStats["os_mem_used_percent"]; got != c.want {
+			t.Errorf("%s: os_mem_used_percent = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestLoadStatsLargeDisk(t *testing.T) {
+	nodesStats := `{"nodes":{"n1":{"name":"big","fs":{"total":{"total_in_bytes":9000000000000000000,"free_in_bytes":0}}}}}`
+	p, done := newTestPlugin(t, &nodesStats)
+	defer done()
+
+	err := p.loadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := metrics["big_disk_used_in_bytes"]; got != 9e18 {
+		t.Errorf("big_disk_used_in_bytes = %v, want 9e18", got)
+	}
+	graph := p.GraphDefinition()["elasticsearch-nodes.DiskUsedInBytes"]
+	if len(graph.Metrics) != 1 || graph.Metrics[0].Type != "float64" {
+		t.Errorf("DiskUsedInBytes metrics = %+v, want one float64 series", graph.Metrics)
+	}
+}
+
+func TestIndicesAddStatsDeletes(t *testing.T) {
+	var indices ElasticsearchNodeIndices
+	err := json.Unmarshal([]byte(`{"indexing":{"delete_total":7,"delete_time_in_millis":30,"delete_current":2}}`), &indices)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodeStats := make(map[string]float64)
+	indices.addStats(nodeStats)
+
+	want := map[string]float64{
+		"indices_indexing_delete_total":          7,
+		"indices_indexing_delete_time_in_millis": 30,
+		"indices_indexing_delete_current":        2,
+	}
+	for key, value := range want {
+		if got, ok := nodeStats[key]; !ok || got != value {
+			t.Errorf("%s = %v (emitted %v), want %v", key, got, ok, value)
+		}
+	}
+	if _, ok := nodeStats["indices_indexing_noop_update_total"]; ok {
+		t.Error("indices_indexing_noop_update_total emitted although the node does not report it")
+	}
+}
+
+func TestIndicesAddStatsWarmer(t *testing.T) {
+	var indices ElasticsearchNodeIndices
+	err := json.Unmarshal([]byte(`{"warmer":{"current":1,"total":12,"total_time_in_millis":340}}`), &indices)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodeStats := make(map[string]float64)
+	indices.addStats(nodeStats)
+
+	want := map[string]float64{
+		"indices_warmer_current":              1,
+		"indices_warmer_total":                12,
+		"indices_warmer_total_time_in_millis": 340,
+	}
+	for key, value := range want {
+		if got := nodeStats[key]; got != value {
+			t.Errorf("%s = %v, want %v", key, got, value)
+		}
+	}
+	p := ElasticsearchNodesPlugin{Stats: map[string]map[string]float64{"node1": nodeStats}}
+	graphs := p.GraphDefinition()
+	for _, name := range []string{"elasticsearch-nodes.IndicesWarmer", "elasticsearch-nodes.IndicesWarmerTime"} {
+		if _, ok := graphs[name]; !ok {
+			t.Errorf("graph %s is not defined", name)
+		}
+	}
+}
+
+func TestIndicesAddStatsCompletion(t *testing.T) {
+	var indices ElasticsearchNodeIndices
+	err := json.Unmarshal([]byte(`{"completion":{"size_in_bytes":4096}}`), &indices)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodeStats := make(map[string]float64)
+	indices.addStats(nodeStats)
+
+	if got := nodeStats["indices_completion_size_in_bytes"]; got != 4096 {
+		t.Errorf("indices_completion_size_in_bytes = %v, want 4096", got)
+	}
+}
+
+func TestDetectUnchangedNodesIgnoresCounters(t *testing.T) {
+	state := &pluginState{Nodes: make(map[string]*nodeState)}
+	state.node("node1").Emitted = map[string]float64{"jvm_mem_heap_used_in_bytes": 100}
+	p := ElasticsearchNodesPlugin{
+		DeltaThreshold: 1,
+		Stats: map[string]map[string]float64{"node1": {
+			"jvm_mem_heap_used_in_bytes": 100,
+			"indices_search_query_total": 1000000,
+			"threadpool_write_rejected":  5,
+		}},
+	}
+
+	p.detectUnchangedNodes(state)
+	if !p.Unchanged["node1"] {
+		t.Error("node whose gauges did not move was emitted")
+	}
+
+	p.Stats["node1"]["jvm_mem_heap_used_in_bytes"] = 200
+	p.detectUnchangedNodes(state)
+	if p.Unchanged["node1"] {
+		t.Error("node whose gauges moved was left out")
+	}
+}
+
+func TestLoadStatsStateReadOnly(t *testing.T) {
+	nodesStats := `{"nodes":{"n1":{"name":"node1"}}}`
+	p, done := newTestPlugin(t, &nodesStats)
+	defer done()
+	p.StateReadOnly = true
+
+	err := p.loadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(p.StateFile); !os.IsNotExist(err) {
+		t.Errorf("state file was written in read only mode: %v", err)
+	}
+}
+
+func TestSegmentsAddBreakdownStats(t *testing.T) {
+	var segments ElasticsearchNodeIndicesSegments
+	err := json.Unmarshal([]byte(`{"terms_memory_in_bytes":0,"norms_memory_in_bytes":0,"index_writer_memory_in_bytes":0}`), &segments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		major int
+		want  []string
+	}{
+		{7, []string{"indices_segments_index_writer_memory_in_bytes", "indices_segments_norms_memory_in_bytes", "indices_segments_terms_memory_in_bytes"}},
+		{8, []string{"indices_segments_index_writer_memory_in_bytes"}},
+	}
+	for _, c := range cases {
+		nodeStats := make(map[string]float64)
+		segments.addBreakdownStats(nodeStats, c.major)
+
+		if got := sortedKeys(nodeStats); strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("version %d: emitted %v, want %v", c.major, got, c.want)
+		}
+	}
+}
+
+func TestLoadStatsCachesNodeInfo(t *testing.T) {
+	var nodesStats string
+	infoRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_nodes/stats" {
+			io.WriteString(w, nodesStats)
+			return
+		}
+		infoRequests++
+		io.WriteString(w, `{"nodes":{"n1":{"version":"8.11.1","total_indexing_buffer":1024},"n2":{"version":"8.11.1"}}}`)
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "elasticsearch-nodes-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := &ElasticsearchNodesPlugin{URI: server.URL, StateFile: filepath.Join(dir, "state")}
+
+	steps := []struct {
+		nodesStats string
+		want       int
+	}{
+		{`{"nodes":{"n1":{"name":"node1","jvm":{"uptime_in_millis":1000}}}}`, 1},
+		{`{"nodes":{"n1":{"name":"node1","jvm":{"uptime_in_millis":2000}}}}`, 1},
+		{`{"nodes":{"n1":{"name":"node1","jvm":{"uptime_in_millis":500}}}}`, 2},
+		{`{"nodes":{"n1":{"name":"node1","jvm":{"uptime_in_millis":600}},"n2":{"name":"node2"}}}`, 3},
+		{`{"nodes":{"n1":{"name":"node1","jvm":{"uptime_in_millis":700}},"n2":{"name":"node2"}}}`, 3},
+	}
+	for i, step := range steps {
+		nodesStats = step.nodesStats
+		err = p.loadStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if infoRequests != step.want {
+			t.Errorf("run %d: %d node info requests, want %d", i+1, infoRequests, step.want)
+		}
+		if got := p.Stats["node1"]["total_indexing_buffer_in_bytes"]; got != 1024 {
+			t.Errorf("run %d: total_indexing_buffer_in_bytes = %v, want 1024", i+1, got)
+		}
+	}
+}
+
+func TestTruncateMetrics(t *testing.T) {
+	cases := []struct {
+		maxMetrics int
+		want       int
+		truncated  float64
+	}{
+		{4, 4, 0},
+		{3, 3, 1},
+		{2, 2, 1},
+	}
+	for _, c := range cases {
+		p := ElasticsearchNodesPlugin{
+			MaxMetrics:   c.maxMetrics,
+			Stats:        map[string]map[string]float64{"node1": {"a": 1, "b": 2}},
+			ClusterStats: map[string]float64{"cluster_c": 3},
+		}
+		p.truncateMetrics()
+
+		metrics, err := p.FetchMetrics()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) != c.want || metrics["plugin_metrics_truncated"] != c.truncated {
+			t.Errorf("max %d: emitted %v, want %d metrics with plugin_metrics_truncated %v", c.maxMetrics, metrics, c.want, c.truncated)
+		}
+	}
+}
+
+func TestNodeTiers(t *testing.T) {
+	cases := []struct {
+		roles []string
+		want  []string
+	}{
+		{[]string{"data_hot", "data_content", "ingest"}, []string{"hot", "content"}},
+		{[]string{"data", "master"}, []string{"data"}},
+		{[]string{"master"}, []string{}},
+		{[]string{}, []string{}},
+	}
+	for _, c := range cases {
+		if got := nodeTiers(c.roles); strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("nodeTiers(%v) = %v, want %v", c.roles, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"time"
+)
+
+const sshTunnelTimeout = 10 * time.Second
+
+// sshTunnel forwards a local port to the Elasticsearch host through a
+// bastion. It runs the system ssh client, so the plugin does not depend on
+// an SSH library and nothing SSH related happens unless -ssh is given.
+type sshTunnel struct {
+	localAddr string
+	cmd       *exec.Cmd
+	exited    chan error
+}
+
+func openSSHTunnel(target, keyFile, host, port string) (*sshTunnel, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	localAddr := l.Addr().String()
+	l.Close()
+
+	args := []string{
+		"-N",
+		"-o", "BatchMode=yes",
+		"-o", "ExitOnForwardFailure=yes",
+		"-L", localAddr + ":" + net.JoinHostPort(host, port),
+	}
+	if keyFile != "" {
+		args = append(args, "-i", keyFile)
+	}
+	args = append(args, target)
+
+	t := &sshTunnel{
+		localAddr: localAddr,
+		cmd:       exec.Command("ssh", args...),
+		exited:    make(chan error, 1),
+	}
+	err = t.cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		t.exited <- t.cmd.Wait()
+	}()
+
+	deadline := time.Now().Add(sshTunnelTimeout)
+	for {
+		select {
+		case err := <-t.exited:
+			return nil, fmt.Errorf("ssh to %s exited before the tunnel was up: %v", target, err)
+		default:
+		}
+
+		conn, err := net.DialTimeout("tcp", localAddr, time.Second)
+		if err == nil {
+			conn.Close()
+			return t, nil
+		}
+		if time.Now().After(deadline) {
+			t.Close()
+			return nil, fmt.Errorf("ssh tunnel via %s not ready after %s: %s", target, sshTunnelTimeout, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Close stops the ssh client and waits for it to exit.
+func (t *sshTunnel) Close() {
+	t.cmd.Process.Kill()
+	<-t.exited
+}
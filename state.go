@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+// pluginState is the data the plugin itself keeps between runs.
+// It lives next to the helper's tempfile.
+type pluginState struct {
+	Run   uint64                `json:"run"`
+	Nodes map[string]*nodeState `json:"nodes"`
+	// NodeInfo is the node info last fetched, if any.
+	NodeInfo *ElasticsearchNodesInfo `json:"node_info,omitempty"`
+}
+
+type nodeState struct {
+	LastSeen uint64             `json:"last_seen"`
+	Emitted  map[string]float64 `json:"emitted,omitempty"`
+	Raw      map[string]float64 `json:"raw,omitempty"`
+}
+
+// loadState reads the state file. An empty state is returned along with any
+// error, so a missing or broken file only costs what depends on history.
+func loadState(path string) (*pluginState, error) {
+	state := &pluginState{Nodes: make(map[string]*nodeState)}
+
+	body, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(body, state)
+	if err != nil {
+		return &pluginState{Nodes: make(map[string]*nodeState)}, err
+	}
+	if state.Nodes == nil {
+		state.Nodes = make(map[string]*nodeState)
+	}
+
+	return state, nil
+}
+
+// node returns the state of the named node, marking it as seen in this run.
+func (s *pluginState) node(nodeName string) *nodeState {
+	ns, ok := s.Nodes[nodeName]
+	if !ok {
+		ns = &nodeState{}
+		s.Nodes[nodeName] = ns
+	}
+	if ns.Raw == nil {
+		ns.Raw = make(map[string]float64)
+	}
+	ns.LastSeen = s.Run
+
+	return ns
+}
+
+func (s *pluginState) save(path string) error {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, body, 0644)
+}
+
+// delta returns how much the counter key has grown since the previous run
+// and records its current value. ok is false on the node's first run and
+// after the counter was reset.
+func (ns *nodeState) delta(key string, value float64) (delta float64, ok bool) {
+	last, seen := ns.Raw[key]
+	ns.Raw[key] = value
+	if !seen || value < last {
+		return 0, false
+	}
+
+	return value - last, true
+}
+
+// ratio returns how much the counter numKey has grown per unit of growth of
+// the counter denKey since the previous run, recording both values. ok is
+// false when either delta is not valid or denKey did not grow.
+func (ns *nodeState) ratio(numKey string, num float64, denKey string, den float64) (ratio float64, ok bool) {
+	numDelta, numOK := ns.delta(numKey, num)
+	denDelta, denOK := ns.delta(denKey, den)
+	if !numOK || !denOK || denDelta == 0 {
+		return 0, false
+	}
+
+	return numDelta / denDelta, true
+}
+
+// prune drops nodes that have not been seen in the last maxRuns runs, so the
+// state file does not keep growing as nodes come and go.
+func (s *pluginState) prune(maxRuns uint64) {
+	for nodeName, ns := range s.Nodes {
+		if s.Run-ns.LastSeen >= maxRuns {
+			delete(s.Nodes, nodeName)
+		}
+	}
+}
+
+// changedBeyond reports whether any metric in cur differs from prev by more
+// than threshold percent, or appeared or disappeared since prev.
+func changedBeyond(prev, cur map[string]float64, threshold float64) bool {
+	if len(prev) != len(cur) {
+		return true
+	}
+	for key, value := range cur {
+		last, ok := prev[key]
+		if !ok {
+			return true
+		}
+		if math.Abs(value-last) > math.Abs(last)*threshold/100 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestPrune(t *testing.T) {
+	state := &pluginState{Nodes: make(map[string]*nodeState)}
+
+	state.Run = 1
+	state.node("gone")
+	state.node("stays")
+	for run := uint64(2); run <= 4; run++ {
+		state.Run = run
+		state.node("stays")
+		state.prune(3)
+
+		_, kept := state.Nodes["gone"]
+		if missing := run - 1; kept != (missing < 3) {
+			t.Errorf("run %d: node missing for %d runs kept = %v", run, missing, kept)
+		}
+		if _, ok := state.Nodes["stays"]; !ok {
+			t.Errorf("run %d: node seen in this run was pruned", run)
+		}
+	}
+}